@@ -0,0 +1,149 @@
+// Command accrual-sim imitates the accrual system for local runs and integration tests.
+// Every order is registered on its first request, reports REGISTERED and PROCESSING for the
+// configured delays and then settles on the status and accrual given by the rules file
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/money"
+	"github.com/valentinaskakun/gophermart/internal/storage"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	Address         string        `env:"ACCRUAL_SIM_ADDRESS"`
+	RulesFile       string        `env:"ACCRUAL_SIM_RULES"`
+	RegisteredDelay time.Duration `env:"ACCRUAL_SIM_REGISTERED_DELAY"`
+	ProcessingDelay time.Duration `env:"ACCRUAL_SIM_PROCESSING_DELAY"`
+	RateLimit       int           `env:"ACCRUAL_SIM_RATE_LIMIT"`
+	ErrorRate       float64       `env:"ACCRUAL_SIM_ERROR_RATE"`
+}
+
+func loadConfig() (configSim Config, err error) {
+	flag.StringVar(&configSim.Address, "a", "localhost:8090", "")
+	flag.StringVar(&configSim.RulesFile, "rules", "", "JSON rules file, every order gets 100 points when empty")
+	flag.DurationVar(&configSim.RegisteredDelay, "registered-delay", time.Second, "how long a new order stays REGISTERED")
+	flag.DurationVar(&configSim.ProcessingDelay, "processing-delay", 2*time.Second, "how long an order stays PROCESSING")
+	flag.IntVar(&configSim.RateLimit, "rate-limit", 0, "requests per minute before answering 429, 0 disables the limit")
+	flag.Float64Var(&configSim.ErrorRate, "error-rate", 0, "share of requests answered with 500, from 0 to 1")
+	flag.Parse()
+	err = env.Parse(&configSim)
+	return
+}
+
+type simOrder struct {
+	registeredAt time.Time
+}
+
+type simulator struct {
+	configSim Config
+	rules     *Rules
+
+	mu          sync.Mutex
+	orders      map[string]simOrder
+	window      time.Time
+	windowCount int
+}
+
+type orderResponse struct {
+	Order   string       `json:"order"`
+	Status  string       `json:"status"`
+	Accrual money.Amount `json:"accrual,omitempty"`
+}
+
+func main() {
+	config.InitLog()
+	configSim, err := loadConfig()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "loadConfig()",
+		}).Fatal(err)
+	}
+	rules, err := LoadRules(configSim.RulesFile)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "LoadRules",
+		}).Fatal(err)
+	}
+	sim := &simulator{
+		configSim: configSim,
+		rules:     rules,
+		orders:    make(map[string]simOrder),
+	}
+	r := chi.NewRouter()
+	r.Get("/api/orders/{number}", sim.GetOrder)
+	log.Fatal(http.ListenAndServe(configSim.Address, r))
+}
+
+// allow counts the request in the current one-minute window, retryAfter is set when the limit is exceeded
+func (s *simulator) allow(now time.Time) (retryAfter time.Duration, ok bool) {
+	if s.configSim.RateLimit <= 0 {
+		return 0, true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.window) >= time.Minute {
+		s.window = now
+		s.windowCount = 0
+	}
+	s.windowCount++
+	if s.windowCount > s.configSim.RateLimit {
+		return s.window.Add(time.Minute).Sub(now), false
+	}
+	return 0, true
+}
+
+func (s *simulator) GetOrder(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	if retryAfter, ok := s.allow(now); !ok {
+		seconds := int(retryAfter.Seconds() + 0.999)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("No more than " + strconv.Itoa(s.configSim.RateLimit) + " requests per minute allowed"))
+		return
+	}
+	if s.configSim.ErrorRate > 0 && rand.Float64() < s.configSim.ErrorRate {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	number := chi.URLParam(r, "number")
+	s.mu.Lock()
+	order, ok := s.orders[number]
+	if !ok {
+		order = simOrder{registeredAt: now}
+		s.orders[number] = order
+	}
+	s.mu.Unlock()
+	response := orderResponse{Order: number}
+	switch elapsed := now.Sub(order.registeredAt); {
+	case elapsed < s.configSim.RegisteredDelay:
+		response.Status = storage.OrderStateRegistered
+	case elapsed < s.configSim.RegisteredDelay+s.configSim.ProcessingDelay:
+		response.Status = storage.OrderStateProcessing
+	default:
+		response.Status, response.Accrual = s.rules.Match(number)
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "GetOrder json.Marshal(response)",
+		}).Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
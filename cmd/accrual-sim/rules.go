@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+
+	"github.com/valentinaskakun/gophermart/internal/money"
+	"github.com/valentinaskakun/gophermart/internal/storage"
+
+	"github.com/pkg/errors"
+)
+
+// Rule decides the final status and accrual of every order number matching Pattern
+type Rule struct {
+	Pattern string       `json:"pattern"`
+	Status  string       `json:"status"`
+	Accrual money.Amount `json:"accrual"`
+
+	re *regexp.Regexp
+}
+
+// Rules are checked in order, the first matching rule wins and Default is used when none matches
+type Rules struct {
+	Rules   []Rule `json:"rules"`
+	Default Rule   `json:"default"`
+}
+
+func defaultRules() *Rules {
+	return &Rules{Default: Rule{Status: storage.OrderStateProcessed, Accrual: 100 * money.Scale}}
+}
+
+func LoadRules(path string) (*Rules, error) {
+	if path == "" {
+		return defaultRules(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read rules %s", path)
+	}
+	rules := defaultRules()
+	if err = json.Unmarshal(data, rules); err != nil {
+		return nil, errors.Wrapf(err, "parse rules %s", path)
+	}
+	for i := range rules.Rules {
+		if rules.Rules[i].re, err = regexp.Compile(rules.Rules[i].Pattern); err != nil {
+			return nil, errors.Wrapf(err, "rule %d", i)
+		}
+		if err = checkFinal(rules.Rules[i].Status); err != nil {
+			return nil, errors.Wrapf(err, "rule %d", i)
+		}
+	}
+	if err = checkFinal(rules.Default.Status); err != nil {
+		return nil, errors.Wrap(err, "default rule")
+	}
+	return rules, nil
+}
+
+func checkFinal(status string) error {
+	if !storage.IsFinalState(status) {
+		return errors.Errorf("status %q must be PROCESSED or INVALID", status)
+	}
+	return nil
+}
+
+// Match returns the final status and accrual for the order number
+func (r *Rules) Match(number string) (status string, accrual money.Amount) {
+	rule := r.Default
+	for _, candidate := range r.Rules {
+		if candidate.re.MatchString(number) {
+			rule = candidate
+			break
+		}
+	}
+	if rule.Status == storage.OrderStateInvalid {
+		return rule.Status, 0
+	}
+	return rule.Status, rule.Accrual
+}
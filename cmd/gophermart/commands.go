@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand handles `gophermart <command> [flags] [args]` and reports whether a command was run,
+// the command name is dropped from os.Args so the usual server flags keep working
+func runCommand() bool {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		return false
+	}
+	command := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	switch command {
+	case "migrate":
+		runMigrate()
+	case "reconcile":
+		runReconcile()
+	case "passwords-status":
+		runPasswordsStatus()
+	default:
+		log.Fatalf("unknown command %q", command)
+	}
+	return true
+}
+
+// runMigrate implements `gophermart migrate [-d uri] up|down|status [steps]`,
+// down without steps rolls back only the latest migration
+func runMigrate() {
+	configRun, err := config.LoadConfigServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	action := "up"
+	if flag.NArg() > 0 {
+		action = flag.Arg(0)
+	}
+	steps := 0
+	if flag.NArg() > 1 {
+		steps, err = strconv.Atoi(flag.Arg(1))
+		if err != nil || steps < 0 {
+			log.Fatalf("bad steps value %q", flag.Arg(1))
+		}
+	}
+	if action == "down" && steps == 0 {
+		steps = 1
+	}
+	store, err := storage.NewPostgresStorage(&configRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	migrator, err := store.Migrator()
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch action {
+	case "up":
+		err = migrator.Up(context.Background(), steps)
+	case "down":
+		err = migrator.Down(context.Background(), steps)
+	case "status":
+	default:
+		log.Fatalf("unknown migrate action %q, expected up, down or status", action)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	status, err := migrator.Status(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, migration := range status {
+		appliedAt := "pending"
+		if migration.Applied {
+			appliedAt = migration.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%04d %-30s %s\n", migration.Version, migration.Name, appliedAt)
+	}
+}
+
+// runReconcile implements `gophermart reconcile [-d uri]`, it lists users whose balance row
+// disagrees with the ledger and exits with code 1 when there is any
+func runReconcile() {
+	configRun, err := config.LoadConfigServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := storage.NewPostgresStorage(&configRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	mismatches, err := store.Reconcile(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, mismatch := range mismatches {
+		fmt.Printf("user %d: current %s (ledger %s), accruals %s (ledger %s), withdrawn %s (ledger %s)\n",
+			mismatch.IDUser, mismatch.Current, mismatch.LedgerCurrent, mismatch.Accruals, mismatch.LedgerAccruals,
+			mismatch.Withdrawn, mismatch.LedgerWithdrawn)
+	}
+	if len(mismatches) > 0 {
+		store.Close()
+		os.Exit(1)
+	}
+	fmt.Println("balances match the ledger")
+}
+
+// runPasswordsStatus implements `gophermart passwords-status [-d uri]`, it reports how many accounts
+// still keep a plaintext password that will be hashed on their next successful login
+func runPasswordsStatus() {
+	configRun, err := config.LoadConfigServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := storage.NewPostgresStorage(&configRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	total, legacy, err := store.CountLegacyPasswords(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d of %d accounts still have an un-migrated password\n", legacy, total)
+}
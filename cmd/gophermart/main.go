@@ -1,38 +1,31 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
+	"github.com/valentinaskakun/gophermart/internal/auth"
 	"github.com/valentinaskakun/gophermart/internal/config"
 	"github.com/valentinaskakun/gophermart/internal/handlers"
+	"github.com/valentinaskakun/gophermart/internal/logging"
 	"github.com/valentinaskakun/gophermart/internal/orders"
 	"github.com/valentinaskakun/gophermart/internal/storage"
 
 	"github.com/go-chi/chi"
-	"github.com/go-chi/jwtauth/v5"
+	"github.com/go-chi/chi/middleware"
 	log "github.com/sirupsen/logrus"
 )
 
-func handleSignal(signal os.Signal) {
-	log.Println("* Got:", signal)
-	os.Exit(-1)
-}
-
 func main() {
 	config.InitLog()
-	var tokenAuth *jwtauth.JWTAuth
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
-	go func() {
-		for {
-			sig := <-sigs
-			handleSignal(sig)
-		}
-	}()
+	if runCommand() {
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer stop()
 	configRun, err := config.LoadConfigServer()
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -40,39 +33,115 @@ func main() {
 		}).Error(err)
 		log.Fatal(err)
 	}
-	tokenAuth = jwtauth.New("HS256", []byte(configRun.KeyToken), nil)
-	err = storage.InitTables(&configRun)
+	tokens, err := auth.NewTokenManager(&configRun)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "auth.NewTokenManager(&configRun)",
+		}).Error(err)
+		log.Fatal(err)
+	}
+	validator, err := orders.NewValidator(&configRun)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "orders.NewValidator(&configRun)",
+		}).Error(err)
+		log.Fatal(err)
+	}
+	store, err := storage.New(&configRun)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "storage.New(&configRun)",
+		}).Error(err)
+		log.Fatal(err)
+	}
+	defer store.Close()
+	err = store.Migrate(ctx)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"func": "storage.InitTables(&configRun)",
+			"func": "store.Migrate(ctx)",
 		}).Error(err)
+		log.Fatal(err)
 	}
-	tickerUpdateAccrual := time.NewTicker(2 * time.Second)
+	processor := orders.NewProcessor(&configRun, store)
+	processorDone := make(chan struct{})
 	go func() {
-		for range tickerUpdateAccrual.C {
-			err := orders.AccrualUpdate(&configRun)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"func": "orders.AccrualUpdate(&configRun)",
-				}).Error(err)
-			}
-		}
+		defer close(processorDone)
+		processor.Run(ctx)
 	}()
 	r := chi.NewRouter()
-	r.Route("/api/user", func(r chi.Router) {
+	r.Use(middleware.RequestID)
+	r.Use(logging.Middleware)
+	r.Route(handlers.UserAPIPath, func(r chi.Router) {
 		r.Group(func(r chi.Router) {
-			r.Use(jwtauth.Verifier(tokenAuth))
-			r.Use(jwtauth.Authenticator)
-			r.Post("/orders", handlers.UploadOrder(&configRun))
-			r.Get("/orders", handlers.GetOrdersList(&configRun))
-			r.Get("/balance", handlers.GetBalance(&configRun))
-			r.Post("/balance/withdraw", handlers.NewWithdraw(&configRun))
-			r.Get("/withdrawals", handlers.GetWithdrawalsList(&configRun))
+			r.Use(tokens.Verifier)
+			r.Use(auth.Authenticator)
+			r.Use(auth.RejectRevoked(store))
+			r.Post("/orders", handlers.UploadOrder(&configRun, store, validator))
+			r.Post("/orders/batch", handlers.UploadOrdersBatch(&configRun, store, validator))
+			r.Get("/orders", handlers.GetOrdersList(&configRun, store))
+			r.Get("/orders/{number}", handlers.GetOrder(&configRun, store))
+			r.Get("/balance", handlers.GetBalance(&configRun, store))
+			r.Post("/balance/withdraw", handlers.NewWithdraw(&configRun, store, validator))
+			r.Get("/withdrawals", handlers.GetWithdrawalsList(&configRun, store))
+			r.Post("/logout", handlers.Logout(&configRun, store))
 		})
 		r.Group(func(r chi.Router) {
-			r.Post("/register", handlers.Register(&configRun))
-			r.Post("/login", handlers.Login(&configRun))
+			r.Post("/register", handlers.Register(&configRun, store, tokens))
+			r.Post("/login", handlers.Login(&configRun, store, tokens))
+			r.Post("/token/refresh", handlers.RefreshToken(&configRun, store, tokens))
 		})
 	})
-	log.Fatal(http.ListenAndServe(configRun.Address, r))
+	if configRun.AccrualCallbackSecret != "" {
+		r.Post("/internal/accrual/callback", handlers.AccrualCallback(&configRun, store))
+	}
+	server := &http.Server{Addr: configRun.Address, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	var metricsServer *http.Server
+	if configRun.MetricsAddress != "" {
+		metricsRouter := chi.NewRouter()
+		metricsRouter.Get("/metrics", handlers.Metrics(&configRun, store))
+		metricsServer = &http.Server{Addr: configRun.MetricsAddress, Handler: metricsRouter}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.WithFields(log.Fields{
+					"func": "metricsServer.ListenAndServe()",
+				}).Error(err)
+			}
+		}()
+	}
+	select {
+	case err = <-serverErr:
+		log.WithFields(log.Fields{
+			"func": "server.ListenAndServe()",
+		}).Error(err)
+		stop()
+		<-processorDone
+		store.Close()
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	// stop taking new requests and let the in-flight ones and the accrual workers finish
+	log.WithFields(log.Fields{
+		"func": "main shutting down",
+	}).Warn()
+	drainCtx, cancel := context.WithTimeout(context.Background(), configRun.ShutdownTimeout)
+	defer cancel()
+	if err = server.Shutdown(drainCtx); err != nil {
+		log.WithFields(log.Fields{
+			"func": "server.Shutdown(drainCtx)",
+		}).Error(err)
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	select {
+	case <-processorDone:
+	case <-drainCtx.Done():
+		log.WithFields(log.Fields{
+			"func": "main accrual workers didn't stop in time",
+		}).Error(drainCtx.Err())
+	}
 }
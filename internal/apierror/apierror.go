@@ -0,0 +1,96 @@
+// Package apierror writes the error envelope every endpoint answers with:
+//
+//	{"code": "order_checksum_invalid", "message": "the order number fails the checksum", "details": {...}, "request_id": "..."}
+//
+// code is stable and meant for programs, message is for humans and may change, details is optional
+// and request_id matches the X-Request-Id response header and the request_id field of the server logs.
+//
+// Error codes:
+//
+//	bad_request              400  the body can't be read or isn't valid JSON
+//	invalid_query            400  a list query parameter (limit, cursor, status, from, to, sort) is malformed
+//	invalid_credentials      401  unknown login or wrong password
+//	unauthorized             401  missing, expired, invalid or revoked access token
+//	invalid_refresh_token    401  unknown, expired or revoked refresh token
+//	invalid_signature        401  accrual callback with a bad or stale HMAC signature
+//	insufficient_funds       402  withdrawal is larger than the current balance
+//	order_not_found          404  accrual callback or order lookup for an order we don't know
+//	login_exists             409  the login is already taken
+//	order_uploaded_by_other  409  the order number was uploaded by another user
+//	withdrawal_exists        409  a withdrawal for this order number was already made
+//	illegal_transition       409  accrual callback would move the order to a state it can't reach
+//	batch_too_large          413  batch upload has more order numbers than ORDER_BATCH_LIMIT or a body too large for them
+//	order_not_number         422  order number isn't made of digits
+//	order_checksum_invalid   422  order number fails the configured checksum, Luhn by default
+//	order_format_invalid     422  order number has a wrong length or prefix for its merchant
+//	invalid_accrual          422  accrual callback with a negative accrual
+//	invalid_sum              422  sum isn't positive or has more than two decimal places
+//	internal_error           500  anything else, see the server logs by request_id
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	log "github.com/sirupsen/logrus"
+)
+
+type Code string
+
+const (
+	CodeBadRequest           Code = "bad_request"
+	CodeInvalidQuery         Code = "invalid_query"
+	CodeInvalidCredentials   Code = "invalid_credentials"
+	CodeUnauthorized         Code = "unauthorized"
+	CodeInvalidRefreshToken  Code = "invalid_refresh_token"
+	CodeInvalidSignature     Code = "invalid_signature"
+	CodeInsufficientFunds    Code = "insufficient_funds"
+	CodeOrderNotFound        Code = "order_not_found"
+	CodeLoginExists          Code = "login_exists"
+	CodeOrderUploadedByOther Code = "order_uploaded_by_other"
+	CodeWithdrawalExists     Code = "withdrawal_exists"
+	CodeIllegalTransition    Code = "illegal_transition"
+	CodeBatchTooLarge        Code = "batch_too_large"
+	CodeOrderNotNumber       Code = "order_not_number"
+	CodeOrderChecksumInvalid Code = "order_checksum_invalid"
+	CodeOrderFormatInvalid   Code = "order_format_invalid"
+	CodeInvalidAccrual       Code = "invalid_accrual"
+	CodeInvalidSum           Code = "invalid_sum"
+	CodeInternal             Code = "internal_error"
+)
+
+type Response struct {
+	Code      Code                   `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+func Write(w http.ResponseWriter, r *http.Request, status int, code Code, message string) {
+	WriteDetails(w, r, status, code, message, nil)
+}
+
+func WriteDetails(w http.ResponseWriter, r *http.Request, status int, code Code, message string, details map[string]interface{}) {
+	body, err := json.Marshal(Response{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "apierror.WriteDetails json.Marshal",
+		}).Error(err)
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Internal answers 500 without leaking the error, it is expected to be logged by the caller
+func Internal(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/logging"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// TokenManager signs access tokens with the current key and accepts tokens signed by any
+// of the configured verification keys, the key is picked by the token's kid header
+type TokenManager struct {
+	algorithm  jwa.SignatureAlgorithm
+	signingKey jwk.Key
+	keySet     jwk.Set
+	issuer     string
+	audience   string
+	ttl        time.Duration
+	refreshTTL time.Duration
+}
+
+func NewTokenManager(configRun *config.Config) (*TokenManager, error) {
+	algorithm := jwa.SignatureAlgorithm(configRun.JWTAlgorithm)
+	switch algorithm {
+	case jwa.HS256, jwa.RS256, jwa.EdDSA:
+	default:
+		return nil, errors.Errorf("unsupported JWT algorithm %q", configRun.JWTAlgorithm)
+	}
+	manager := &TokenManager{
+		algorithm:  algorithm,
+		keySet:     jwk.NewSet(),
+		issuer:     configRun.JWTIssuer,
+		audience:   configRun.JWTAudience,
+		ttl:        configRun.JWTTTL,
+		refreshTTL: configRun.JWTRefreshTTL,
+	}
+	var err error
+	manager.signingKey, err = loadSigningKey(configRun, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err = manager.addVerificationKey(manager.signingKey); err != nil {
+		return nil, err
+	}
+	for _, entry := range configRun.JWTVerificationKeys {
+		kid, path, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" || path == "" {
+			return nil, errors.Errorf("bad verification key %q, expected kid=path", entry)
+		}
+		key, errKey := readKeyFile(path, algorithm)
+		if errKey != nil {
+			return nil, errKey
+		}
+		if err = key.Set(jwk.KeyIDKey, kid); err != nil {
+			return nil, err
+		}
+		if err = manager.addVerificationKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return manager, nil
+}
+
+func loadSigningKey(configRun *config.Config, algorithm jwa.SignatureAlgorithm) (key jwk.Key, err error) {
+	switch {
+	case configRun.JWTKeyFile != "":
+		key, err = readKeyFile(configRun.JWTKeyFile, algorithm)
+	case algorithm == jwa.HS256 && configRun.JWTSecret != "":
+		key, err = jwk.New([]byte(configRun.JWTSecret))
+	case algorithm == jwa.HS256:
+		// a generated key would log everyone out on restart and split replicas, so refuse to start
+		err = errors.Errorf("JWT algorithm %s needs JWT_SECRET or JWT_KEY_FILE", algorithm)
+	default:
+		err = errors.Errorf("JWT algorithm %s needs a private key file", algorithm)
+	}
+	if err != nil {
+		return
+	}
+	err = key.Set(jwk.KeyIDKey, configRun.JWTKeyID)
+	return
+}
+
+// readKeyFile reads a raw secret for HS256 or a PEM encoded key for RS256 and EdDSA
+func readKeyFile(path string, algorithm jwa.SignatureAlgorithm) (jwk.Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read JWT key %s", path)
+	}
+	if algorithm == jwa.HS256 {
+		return jwk.New([]byte(strings.TrimSpace(string(data))))
+	}
+	key, err := jwk.ParseKey(data, jwk.WithPEM(true))
+	return key, errors.Wrapf(err, "parse JWT key %s", path)
+}
+
+func (m *TokenManager) addVerificationKey(key jwk.Key) error {
+	public, err := jwk.PublicKeyOf(key)
+	if err != nil {
+		return err
+	}
+	if err = public.Set(jwk.AlgorithmKey, m.algorithm); err != nil {
+		return err
+	}
+	m.keySet.Add(public)
+	return nil
+}
+
+func (m *TokenManager) TTL() time.Duration {
+	return m.ttl
+}
+
+func (m *TokenManager) RefreshTTL() time.Duration {
+	return m.refreshTTL
+}
+
+// Issue returns a signed access token for the user and its expiry time,
+// sessionID ties the token to the refresh token it was issued with
+func (m *TokenManager) Issue(userID int, login string, sessionID string) (tokenString string, expiresAt time.Time, err error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	expiresAt = now.Add(m.ttl)
+	token := jwt.New()
+	claims := map[string]interface{}{
+		jwt.JwtIDKey:      jti,
+		jwt.IssuerKey:     m.issuer,
+		jwt.AudienceKey:   m.audience,
+		jwt.IssuedAtKey:   now,
+		jwt.ExpirationKey: expiresAt,
+		"id_user":         userID,
+		"login":           login,
+		"sid":             sessionID,
+	}
+	for name, value := range claims {
+		if err = token.Set(name, value); err != nil {
+			return
+		}
+	}
+	signed, err := jwt.Sign(token, m.algorithm, m.signingKey)
+	tokenString = string(signed)
+	return
+}
+
+// Parse verifies the signature, expiry, issuer and audience of an access token
+func (m *TokenManager) Parse(tokenString string) (jwt.Token, error) {
+	return jwt.Parse([]byte(tokenString),
+		jwt.WithKeySet(m.keySet),
+		jwt.UseDefaultKey(true),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(m.issuer),
+		jwt.WithAudience(m.audience),
+	)
+}
+
+// Verifier replaces jwtauth.Verifier, it stores the parsed token in the request context
+// so Authenticator and jwtauth.FromContext keep working
+func (m *TokenManager) Verifier(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token jwt.Token
+		err := jwtauth.ErrNoTokenFound
+		for _, find := range []func(r *http.Request) string{jwtauth.TokenFromHeader, jwtauth.TokenFromCookie} {
+			if tokenString := find(r); tokenString != "" {
+				token, err = m.Parse(tokenString)
+				break
+			}
+		}
+		if err != nil && err != jwtauth.ErrNoTokenFound {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "auth.Verifier",
+			}).Info(err)
+			err = jwtauth.ErrorReason(err)
+		}
+		next.ServeHTTP(w, r.WithContext(jwtauth.NewContext(r.Context(), token, err)))
+	})
+}
@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+
+	"github.com/caarlos0/env/v6"
+)
+
+func TestNewTokenManagerNeedsSecret(t *testing.T) {
+	var configRun config.Config
+	if err := env.Parse(&configRun); err != nil {
+		t.Fatal(err)
+	}
+	configRun.JWTSecret = ""
+	configRun.JWTKeyFile = ""
+	if _, err := NewTokenManager(&configRun); err == nil {
+		t.Fatal("HS256 without a secret started with a generated key")
+	}
+
+	configRun.JWTSecret = "test-secret-test-secret-test-secret"
+	if _, err := NewTokenManager(&configRun); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/valentinaskakun/gophermart/internal/apierror"
+	"github.com/valentinaskakun/gophermart/internal/logging"
+	"github.com/valentinaskakun/gophermart/internal/storage"
+
+	"github.com/go-chi/jwtauth/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+func randomString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// NewRefreshToken returns an opaque refresh token for the client and the session id kept on the server,
+// only a hash of the token is stored so a leaked sessions table can't be used to refresh
+func NewRefreshToken() (refreshToken string, sessionID string, err error) {
+	refreshToken, err = randomString(32)
+	if err != nil {
+		return
+	}
+	sessionID = SessionID(refreshToken)
+	return
+}
+
+func SessionID(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticator replaces jwtauth.Authenticator, it answers 401 with the JSON error envelope
+// when Verifier found no valid access token
+func Authenticator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _, err := jwtauth.FromContext(r.Context())
+		if err != nil || token == nil {
+			apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeUnauthorized, "a valid access token is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RejectRevoked goes after Authenticator and answers 401 for access tokens put on the denylist by logout
+func RejectRevoked(store storage.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _, _ := jwtauth.FromContext(r.Context())
+			if token == nil {
+				apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeUnauthorized, "a valid access token is required")
+				return
+			}
+			revoked, err := store.IsTokenRevoked(r.Context(), token.JwtID())
+			if err != nil {
+				logging.FromContext(r.Context()).WithFields(log.Fields{
+					"func": "auth.RejectRevoked.IsTokenRevoked",
+				}).Error(err)
+				apierror.Internal(w, r)
+				return
+			}
+			if revoked {
+				apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeUnauthorized, "the access token has been revoked")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
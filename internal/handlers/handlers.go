@@ -1,237 +1,658 @@
 package handlers
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/valentinaskakun/gophermart/internal/apierror"
+	"github.com/valentinaskakun/gophermart/internal/auth"
 	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/logging"
+	"github.com/valentinaskakun/gophermart/internal/money"
 	"github.com/valentinaskakun/gophermart/internal/orders"
+	"github.com/valentinaskakun/gophermart/internal/passwords"
 	"github.com/valentinaskakun/gophermart/internal/storage"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
 	"github.com/go-chi/jwtauth/v5"
+	"github.com/pkg/errors"
 )
 
-func Register(configRun *config.Config) func(w http.ResponseWriter, r *http.Request) {
+func Register(configRun *config.Config, store storage.Store, tokens *auth.TokenManager) func(w http.ResponseWriter, r *http.Request) {
+	hasher := passwords.NewHasher(configRun)
 	return func(w http.ResponseWriter, r *http.Request) {
-		expirationTime := time.Now().Add(360 * time.Minute)
 		registerUser := storage.CredUserStruct{}
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "Register ioutil.ReadAll(r.Body)",
 			}).Error(err)
-			w.WriteHeader(http.StatusBadRequest)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read the request body")
 			return
 		}
 		if err := json.Unmarshal(body, &registerUser); err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "Register json.Unmarshal(body, &registerUser)",
 			}).Error(err)
-			w.WriteHeader(http.StatusBadRequest)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "the body must be a JSON object with login and password")
 			return
 		}
-		userInfo, err := storage.ReturnIDByLogin(configRun, &registerUser.Login)
+		registerUser.Password, err = hasher.Hash(registerUser.Password)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "Register.ReturnIDByLogin)",
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "Register.hasher.Hash",
 			}).Error(err)
+			apierror.Internal(w, r)
 			return
 		}
-		if userInfo.IDUser != 0 {
-			log.WithFields(log.Fields{
+		registerUserID, err := store.InsertUser(r.Context(), &registerUser)
+		if err == storage.ErrLoginExists {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "Register The login exists",
 			}).Info()
-			w.WriteHeader(http.StatusConflict)
+			apierror.Write(w, r, http.StatusConflict, apierror.CodeLoginExists, "the login is already taken")
 			return
 		}
-		registerUserID, err := storage.InsertUser(configRun, &registerUser)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "Register.storage.InsertUser",
 			}).Error(err)
+			apierror.Internal(w, r)
 			return
 		}
-		userAuthInfo := storage.UsingUserStruct{
-			Login:  registerUser.Login,
-			IDUser: registerUserID,
-			StandardClaims: jwt.StandardClaims{
-				ExpiresAt: expirationTime.Unix(),
-			},
-		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, userAuthInfo)
-		tokenString, err := token.SignedString([]byte(configRun.KeyToken))
+		err = startSession(r.Context(), configRun, w, store, tokens, registerUserID, registerUser.Login)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "Register.tokenPreparing",
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "Register.startSession",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:    "jwt",
-			Value:   tokenString,
-			Expires: expirationTime,
-		})
-		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func Login(configRun *config.Config) func(w http.ResponseWriter, r *http.Request) {
+func Login(configRun *config.Config, store storage.Store, tokens *auth.TokenManager) func(w http.ResponseWriter, r *http.Request) {
+	hasher := passwords.NewHasher(configRun)
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		expirationTime := time.Now().Add(5 * time.Minute)
 		var userCred storage.CredUserStruct
 		err := json.NewDecoder(r.Body).Decode(&userCred)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "Login.json.NewDecoder",
 			}).Error(err)
-			w.WriteHeader(http.StatusBadRequest)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "the body must be a JSON object with login and password")
 			return
 		}
-		userInfo, err := storage.ReturnIDByLogin(configRun, &userCred.Login)
+		userInfo, err := store.ReturnIDByLogin(r.Context(), &userCred.Login)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "Login.ReturnIDByLogin",
 			}).Error(err)
 		}
 		if userInfo.IDUser == 0 {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "Login.the login doesn't exist",
 			}).Info()
-			w.WriteHeader(http.StatusUnauthorized)
+			apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeInvalidCredentials, "wrong login or password")
 			return
 		}
-		result, err := storage.CheckUserPass(configRun, &userCred)
+		storedPassword, err := store.ReturnPasswordByLogin(r.Context(), &userCred.Login)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "Login.CheckUserPass can't check the pass",
-			}).Info()
-			w.WriteHeader(http.StatusBadRequest)
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "Login.ReturnPasswordByLogin",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+		result, err := hasher.Verify(storedPassword, userCred.Password)
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "Login.hasher.Verify can't check the pass",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
 		}
 		if !result {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "Login.the pass doesn't match",
 			}).Info()
-			w.WriteHeader(http.StatusUnauthorized)
+			apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeInvalidCredentials, "wrong login or password")
 			return
 		}
-		userAuthInfo := storage.UsingUserStruct{
-			Login:  userCred.Login,
-			IDUser: userInfo.IDUser,
-			StandardClaims: jwt.StandardClaims{
-				ExpiresAt: expirationTime.Unix(),
-			},
+		if hasher.NeedsRehash(storedPassword) {
+			rehashed, err := hasher.Hash(userCred.Password)
+			if err == nil {
+				err = store.UpdateUserPassword(r.Context(), &userCred.Login, rehashed)
+			}
+			if err != nil {
+				logging.FromContext(r.Context()).WithFields(log.Fields{
+					"func": "Login.rehash the pass",
+				}).Error(err)
+			}
 		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, userAuthInfo)
-		tokenString, err := token.SignedString([]byte(configRun.KeyToken))
+		err = startSession(r.Context(), configRun, w, store, tokens, userInfo.IDUser, userCred.Login)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "Login.tokenPreparing",
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "Login.startSession",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:    "jwt",
-			Value:   tokenString,
-			Expires: expirationTime,
-		})
-		w.WriteHeader(http.StatusOK)
 	}
 
 }
 
-func UploadOrder(configRun *config.Config) func(w http.ResponseWriter, r *http.Request) {
+type tokenResponse struct {
+	AccessToken      string    `json:"access_token"`
+	TokenType        string    `json:"token_type"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	ExpiresIn        int64     `json:"expires_in"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// startSession creates a refresh-token session for the user and answers with the issued tokens
+func startSession(ctx context.Context, configRun *config.Config, w http.ResponseWriter, store storage.Store, tokens *auth.TokenManager, userID int, login string) (err error) {
+	refreshToken, sessionID, err := auth.NewRefreshToken()
+	if err != nil {
+		return
+	}
+	session := storage.SessionStruct{
+		IDSession: sessionID,
+		IDUser:    userID,
+		Login:     login,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(tokens.RefreshTTL()),
+	}
+	if err = store.InsertSession(ctx, &session); err != nil {
+		return
+	}
+	return writeSession(configRun, w, tokens, &session, refreshToken)
+}
+
+// UserAPIPath is where the user API is mounted, the refresh cookie is scoped to it
+// so browsers send it to the refresh and logout routes only
+const UserAPIPath = "/api/user"
+
+// writeSession hands the tokens out three ways: cookies for browsers, the Authorization header
+// and a JSON body for mobile and server-to-server clients
+func writeSession(configRun *config.Config, w http.ResponseWriter, tokens *auth.TokenManager, session *storage.SessionStruct, refreshToken string) (err error) {
+	tokenString, expirationTime, err := tokens.Issue(session.IDUser, session.Login, session.IDSession)
+	if err != nil {
+		return
+	}
+	tokenJSON, err := json.Marshal(tokenResponse{
+		AccessToken:      tokenString,
+		TokenType:        "Bearer",
+		ExpiresAt:        expirationTime,
+		ExpiresIn:        int64(tokens.TTL().Seconds()),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: session.ExpiresAt,
+	})
+	if err != nil {
+		return
+	}
+	accessCookie := newCookie(configRun, "jwt", tokenString, configRun.CookiePath)
+	accessCookie.Expires = expirationTime
+	http.SetCookie(w, accessCookie)
+	refreshCookie := newCookie(configRun, "refresh_token", refreshToken, UserAPIPath)
+	refreshCookie.Expires = session.ExpiresAt
+	refreshCookie.HttpOnly = true
+	http.SetCookie(w, refreshCookie)
+	w.Header().Set("Authorization", "Bearer "+tokenString)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(tokenJSON)
+	return
+}
+
+func newCookie(configRun *config.Config, name string, value string, path string) *http.Cookie {
+	sameSite := http.SameSiteLaxMode
+	switch strings.ToLower(configRun.CookieSameSite) {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	case "":
+		sameSite = http.SameSiteDefaultMode
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   configRun.CookieDomain,
+		Secure:   configRun.CookieSecure,
+		HttpOnly: configRun.CookieHTTPOnly,
+		SameSite: sameSite,
+	}
+}
+
+func clearSessionCookies(configRun *config.Config, w http.ResponseWriter) {
+	accessCookie := newCookie(configRun, "jwt", "", configRun.CookiePath)
+	accessCookie.MaxAge = -1
+	http.SetCookie(w, accessCookie)
+	refreshCookie := newCookie(configRun, "refresh_token", "", UserAPIPath)
+	refreshCookie.MaxAge = -1
+	refreshCookie.HttpOnly = true
+	http.SetCookie(w, refreshCookie)
+}
+
+func RefreshToken(configRun *config.Config, store storage.Store, tokens *auth.TokenManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var refreshReq struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if cookie, err := r.Cookie("refresh_token"); err == nil {
+			refreshReq.RefreshToken = cookie.Value
+		} else if err := json.NewDecoder(r.Body).Decode(&refreshReq); err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "RefreshToken.json.NewDecoder",
+			}).Info(err)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "the body must be a JSON object with refresh_token")
+			return
+		}
+		if refreshReq.RefreshToken == "" {
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "refresh_token is required")
+			return
+		}
+		newRefreshToken, newSessionID, err := auth.NewRefreshToken()
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "RefreshToken.auth.NewRefreshToken",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+		session := storage.SessionStruct{
+			IDSession: newSessionID,
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(tokens.RefreshTTL()),
+		}
+		oldSession, rotated, err := store.RotateSession(r.Context(), auth.SessionID(refreshReq.RefreshToken), &session)
+		if err == storage.ErrNotFound {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "RefreshToken unknown refresh token",
+			}).Info()
+			apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeInvalidRefreshToken, "unknown refresh token")
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "RefreshToken.RotateSession",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+		if !rotated {
+			if oldSession.Revoked {
+				// a revoked refresh token came back, it may have been stolen so end every session of the user
+				logging.FromContext(r.Context()).WithFields(log.Fields{
+					"func": "RefreshToken revoked refresh token reused",
+				}).Warn(oldSession.IDUser)
+				if err = store.RevokeUserSessions(r.Context(), oldSession.IDUser); err != nil {
+					logging.FromContext(r.Context()).WithFields(log.Fields{
+						"func": "RefreshToken.RevokeUserSessions",
+					}).Error(err)
+				}
+			}
+			clearSessionCookies(configRun, w)
+			apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeInvalidRefreshToken, "the refresh token is expired or revoked")
+			return
+		}
+		if err = writeSession(configRun, w, tokens, &session, newRefreshToken); err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "RefreshToken.writeSession",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+	}
+}
+
+func Logout(configRun *config.Config, store storage.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, claims, _ := jwtauth.FromContext(r.Context())
+		if sessionID, ok := claims["sid"].(string); ok && sessionID != "" {
+			if err := store.RevokeSession(r.Context(), sessionID); err != nil {
+				logging.FromContext(r.Context()).WithFields(log.Fields{
+					"func": "Logout.RevokeSession",
+				}).Error(err)
+				apierror.Internal(w, r)
+				return
+			}
+		}
+		if err := store.RevokeToken(r.Context(), token.JwtID(), token.Expiration()); err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "Logout.RevokeToken",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+		clearSessionCookies(configRun, w)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func UploadOrder(configRun *config.Config, store storage.Store, validator orders.OrderValidator) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		_, claims, _ := jwtauth.FromContext(r.Context())
 		userID := int((claims["id_user"]).(float64))
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "UploadOrder.ioutil.ReadAll(r.Body)",
 			}).Error(err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		orderID, err := strconv.Atoi(string(body))
-		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "UploadOrder.strconv.Atoi(string(body)",
-			}).Error(err)
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read the request body")
 			return
 		}
-		if !orders.CheckOrderID(orderID) {
-			log.WithFields(log.Fields{
-				"func": "UploadOrder CRC failed",
-			}).Info()
-			w.WriteHeader(http.StatusUnprocessableEntity)
+		orderID := strings.TrimSpace(string(body))
+		if err = validator.Validate(orderID); err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "UploadOrder.validator.Validate " + orderID,
+			}).Info(err)
+			code, message := orderValidationError(err)
+			apierror.Write(w, r, http.StatusUnprocessableEntity, code, message)
 			return
 		}
-		orderInfo, err := storage.ReturnOrderInfoByID(configRun, &orderID)
+		orderInfo, err := store.ReturnOrderInfoByID(r.Context(), orderID)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "UploadOrder.ReturnOrderInfoByID",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
-		if orderInfo.IDOrder != 0 && orderInfo.State != "" {
+		if orderInfo.State != "" {
 			if orderInfo.IDUser == userID {
-				log.WithFields(log.Fields{
+				logging.FromContext(r.Context()).WithFields(log.Fields{
 					"func": "UploadOrder.номер заказа загружен этим пользователем",
 				}).Info()
 				w.WriteHeader(http.StatusOK)
 				return
 			} else {
-				log.WithFields(log.Fields{
+				logging.FromContext(r.Context()).WithFields(log.Fields{
 					"func": "UploadOrder.номер заказа загружен не этим пользователем",
 				}).Info()
-				w.WriteHeader(http.StatusConflict)
+				apierror.Write(w, r, http.StatusConflict, apierror.CodeOrderUploadedByOther, "the order number was uploaded by another user")
 				return
 			}
 
 		}
 
 		orderInfo.IDUser = userID
-		orderInfo.State = "NEW"
+		orderInfo.State = storage.OrderStateNew
 		orderInfo.UploadedAt = time.Now()
 
-		err = storage.InsertOrder(configRun, &orderInfo)
+		err = store.InsertOrder(r.Context(), &orderInfo)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "UploadOrder.InsertOrder",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
 		w.WriteHeader(http.StatusAccepted)
 	}
 }
 
-func GetOrdersList(configRun *config.Config) func(w http.ResponseWriter, r *http.Request) {
+// Statuses of a batch item, each one answers like UploadOrder would for that number alone
+const (
+	BatchAccepted = "accepted"
+	BatchUploaded = "uploaded"
+	BatchConflict = "conflict"
+	BatchInvalid  = "invalid"
+)
+
+// batchItemBytes is the body size allowed per item of ORDER_BATCH_LIMIT, room for a long
+// order number with its quotes, separator and whitespace
+const batchItemBytes = 64
+
+type BatchOrderResult struct {
+	Order      string        `json:"order"`
+	Status     string        `json:"status"`
+	StatusCode int           `json:"status_code"`
+	Code       apierror.Code `json:"code,omitempty"`
+	Message    string        `json:"message,omitempty"`
+}
+
+// UploadOrdersBatch takes a JSON array or newline-delimited order numbers, valid numbers are
+// inserted in one transaction and every item gets its own result in the order of the request
+func UploadOrdersBatch(configRun *config.Config, store storage.Store, validator orders.OrderValidator) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int((claims["id_user"]).(float64))
+		maxBytes := int64(configRun.OrderBatchLimit) * batchItemBytes
+		if maxBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		// MaxBytesReader fails right at the limit, go 1.18 has no typed error to tell it from a broken read
+		if err != nil && maxBytes > 0 && int64(len(body)) >= maxBytes {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "UploadOrdersBatch.http.MaxBytesReader",
+			}).Info(err)
+			apierror.WriteDetails(w, r, http.StatusRequestEntityTooLarge, apierror.CodeBatchTooLarge, "the batch body is too large",
+				map[string]interface{}{"max_bytes": maxBytes})
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "UploadOrdersBatch.ioutil.ReadAll(r.Body)",
+			}).Error(err)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read the request body")
+			return
+		}
+		numbers, err := parseBatch(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "UploadOrdersBatch.parseBatch",
+			}).Info(err)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "the body must be a JSON array of order numbers or one order number per line")
+			return
+		}
+		if len(numbers) == 0 {
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "the batch has no order numbers")
+			return
+		}
+		if configRun.OrderBatchLimit > 0 && len(numbers) > configRun.OrderBatchLimit {
+			apierror.WriteDetails(w, r, http.StatusRequestEntityTooLarge, apierror.CodeBatchTooLarge, "too many order numbers in the batch",
+				map[string]interface{}{"max_items": configRun.OrderBatchLimit})
+			return
+		}
+		arrResults := make([]BatchOrderResult, len(numbers))
+		var arrOrders []storage.UsingOrderStruct
+		var positions []int
+		uploadedAt := time.Now()
+		for i, number := range numbers {
+			arrResults[i].Order = number
+			if err = validator.Validate(number); err != nil {
+				arrResults[i].Status, arrResults[i].StatusCode = BatchInvalid, http.StatusUnprocessableEntity
+				arrResults[i].Code, arrResults[i].Message = orderValidationError(err)
+				continue
+			}
+			arrOrders = append(arrOrders, storage.UsingOrderStruct{
+				Number:     number,
+				IDUser:     userID,
+				State:      storage.OrderStateNew,
+				UploadedAt: uploadedAt,
+			})
+			positions = append(positions, i)
+		}
+		if len(arrOrders) > 0 {
+			arrInserted, err := store.InsertOrders(r.Context(), arrOrders)
+			if err != nil {
+				logging.FromContext(r.Context()).WithFields(log.Fields{
+					"func": "UploadOrdersBatch.InsertOrders",
+				}).Error(err)
+				apierror.Internal(w, r)
+				return
+			}
+			for j, inserted := range arrInserted {
+				result := &arrResults[positions[j]]
+				switch {
+				case inserted.Inserted:
+					result.Status, result.StatusCode = BatchAccepted, http.StatusAccepted
+				case inserted.IDUser == userID:
+					result.Status, result.StatusCode = BatchUploaded, http.StatusOK
+				default:
+					result.Status, result.StatusCode = BatchConflict, http.StatusConflict
+					result.Code, result.Message = apierror.CodeOrderUploadedByOther, "the order number was uploaded by another user"
+				}
+			}
+		}
+		resultsJSON, err := json.Marshal(arrResults)
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "UploadOrdersBatch.Marshal(arrResults)",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(resultsJSON)
+	}
+}
+
+// parseBatch reads a JSON array of strings or numbers when the body is JSON, otherwise one number per line,
+// blank lines are skipped
+func parseBatch(contentType string, body []byte) (numbers []string, err error) {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(contentType, "application/json") || strings.HasPrefix(trimmed, "[") {
+		var arrRaw []json.RawMessage
+		if err = json.Unmarshal(body, &arrRaw); err != nil {
+			return nil, err
+		}
+		numbers = make([]string, 0, len(arrRaw))
+		for _, raw := range arrRaw {
+			var number string
+			if err = json.Unmarshal(raw, &number); err != nil {
+				// numbers may come unquoted, keep their digits exactly as sent
+				number = string(raw)
+			}
+			numbers = append(numbers, strings.TrimSpace(number))
+		}
+		return numbers, nil
+	}
+	for _, line := range strings.Split(trimmed, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			numbers = append(numbers, line)
+		}
+	}
+	return numbers, nil
+}
+
+// parseListFilter reads limit, cursor, sort (asc or desc), from and to (RFC 3339) and, for orders,
+// status (comma-separated or repeated) from the query string, on error it answers 400 itself
+func parseListFilter(configRun *config.Config, w http.ResponseWriter, r *http.Request, withStates bool) (filter *storage.ListFilter, ok bool) {
+	query := r.URL.Query()
+	filter = &storage.ListFilter{Limit: configRun.ListDefaultLimit}
+	invalid := func(param, message string) (*storage.ListFilter, bool) {
+		apierror.WriteDetails(w, r, http.StatusBadRequest, apierror.CodeInvalidQuery, message,
+			map[string]interface{}{"param": param})
+		return nil, false
+	}
+	if value := query.Get("limit"); value != "" {
+		message := "limit must be a positive number"
+		if configRun.ListMaxLimit > 0 {
+			message = "limit must be a number from 1 to " + strconv.Itoa(configRun.ListMaxLimit)
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return invalid("limit", message)
+		}
+		if configRun.ListMaxLimit > 0 && limit > configRun.ListMaxLimit {
+			return invalid("limit", message)
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := storage.DecodeListCursor(value)
+		if err != nil {
+			return invalid("cursor", "cursor must be the X-Next-Cursor of a previous page")
+		}
+		filter.Cursor = cursor
+	}
+	switch strings.ToLower(query.Get("sort")) {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return invalid("sort", "sort must be asc or desc")
+	}
+	for _, param := range []string{"from", "to"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return invalid(param, param+" must be an RFC 3339 timestamp")
+		}
+		if param == "from" {
+			filter.From = at
+		} else {
+			filter.To = at
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return invalid("from", "from must be before to")
+	}
+	for _, value := range query["status"] {
+		if !withStates {
+			return invalid("status", "withdrawals can't be filtered by status")
+		}
+		for _, state := range strings.Split(value, ",") {
+			state = strings.ToUpper(strings.TrimSpace(state))
+			if !storage.IsOrderState(state) {
+				return invalid("status", "unknown order status "+state)
+			}
+			filter.States = append(filter.States, state)
+		}
+	}
+	return filter, true
+}
+
+// writePageHeaders sets X-Total-Count and, when there are more rows, X-Next-Cursor
+func writePageHeaders(w http.ResponseWriter, page storage.ListPage) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.Next != nil {
+		w.Header().Set("X-Next-Cursor", page.Next.Encode())
+	}
+}
+
+func GetOrdersList(configRun *config.Config, store storage.Store) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		_, claims, _ := jwtauth.FromContext(r.Context())
 		userID := int((claims["id_user"]).(float64))
-		isOrders, arrOrders, err := storage.ReturnOrdersInfoByUserID(configRun, userID)
+		filter, ok := parseListFilter(configRun, w, r, true)
+		if !ok {
+			return
+		}
+		isOrders, arrOrders, page, err := store.ReturnOrdersInfoByUserID(r.Context(), userID, filter)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "GetOrdersList.ReturnOrdersInfoByUserID",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
+		writePageHeaders(w, page)
 		if !isOrders {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "UploadOrder.нет данных для ответа",
 			}).Info()
 			w.WriteHeader(http.StatusNoContent)
@@ -239,10 +660,10 @@ func GetOrdersList(configRun *config.Config) func(w http.ResponseWriter, r *http
 		}
 		ordersJSON, err := json.Marshal(arrOrders)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "GetOrdersList.Marshal(arrOrders)",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -250,24 +671,109 @@ func GetOrdersList(configRun *config.Config) func(w http.ResponseWriter, r *http
 	}
 }
 
-func GetBalance(configRun *config.Config) func(w http.ResponseWriter, r *http.Request) {
+type orderDetail struct {
+	Number     string                            `json:"number"`
+	Status     string                            `json:"status"`
+	Accrual    money.Amount                      `json:"accrual,omitempty"`
+	UploadedAt time.Time                         `json:"uploaded_at"`
+	History    []storage.OrderStatusChangeStruct `json:"history"`
+}
+
+// GetOrder answers the current state of one of the user's orders with every state change it went through,
+// orders of other users are reported as not found
+func GetOrder(configRun *config.Config, store storage.Store) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		_, claims, _ := jwtauth.FromContext(r.Context())
 		userID := int((claims["id_user"]).(float64))
-		balanceInfo, err := storage.ReturnBalanceByUserID(configRun, &userID)
+		orderID := chi.URLParam(r, "number")
+		if !orders.IsDigits(orderID) {
+			apierror.Write(w, r, http.StatusUnprocessableEntity, apierror.CodeOrderNotNumber, orders.ErrNotNumber.Error())
+			return
+		}
+		orderInfo, err := store.ReturnOrderInfoByID(r.Context(), orderID)
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "GetOrder.ReturnOrderInfoByID",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+		if orderInfo.State == "" || orderInfo.IDUser != userID {
+			apierror.Write(w, r, http.StatusNotFound, apierror.CodeOrderNotFound, "unknown order")
+			return
+		}
+		arrHistory, err := store.ReturnOrderHistory(r.Context(), orderID)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "GetOrder.ReturnOrderHistory",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+		if arrHistory == nil {
+			arrHistory = []storage.OrderStatusChangeStruct{}
+		}
+		orderJSON, err := json.Marshal(orderDetail{
+			Number:     orderInfo.Number,
+			Status:     orderInfo.State,
+			Accrual:    orderInfo.Accrual,
+			UploadedAt: orderInfo.UploadedAt,
+			History:    arrHistory,
+		})
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "GetOrder.json.Marshal(orderDetail)",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(orderJSON)
+	}
+}
+
+type metricsResponse struct {
+	IllegalOrderTransitions int64 `json:"illegal_order_transitions"`
+}
+
+// Metrics answers the process counters, it is served on METRICS_ADDRESS and not on the public API
+func Metrics(configRun *config.Config, store storage.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metricsJSON, err := json.Marshal(metricsResponse{
+			IllegalOrderTransitions: storage.IllegalTransitions(),
+		})
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "Metrics.json.Marshal(metricsResponse)",
+			}).Error(err)
+			apierror.Internal(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(metricsJSON)
+	}
+}
+
+func GetBalance(configRun *config.Config, store storage.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		userID := int((claims["id_user"]).(float64))
+		balanceInfo, err := store.ReturnBalanceByUserID(r.Context(), &userID)
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "GetBalance.ReturnBalanceByUserID",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
 		balanceJSON, err := json.Marshal(balanceInfo)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "GetBalance.json.Marshal(balanceInfo)",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -276,83 +782,180 @@ func GetBalance(configRun *config.Config) func(w http.ResponseWriter, r *http.Re
 	}
 }
 
-func NewWithdraw(configRun *config.Config) func(w http.ResponseWriter, r *http.Request) {
+func NewWithdraw(configRun *config.Config, store storage.Store, validator orders.OrderValidator) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		_, claims, _ := jwtauth.FromContext(r.Context())
 		userID := int((claims["id_user"]).(float64))
 		orderToWithdrawReq := storage.OrderToWithdrawStruct{}
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "NewWithdraw.ioutil.ReadAll(r.Body)",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read the request body")
 			return
 		}
-		if err := json.Unmarshal(body, &orderToWithdrawReq); err != nil {
-			log.WithFields(log.Fields{
-				"func": "NewWithdraw.json.Unmarshal(body, &orderToWithdrawReq)",
-			}).Error(err)
-			w.WriteHeader(http.StatusUnprocessableEntity)
+		err = json.Unmarshal(body, &orderToWithdrawReq)
+		if errors.Is(err, money.ErrPrecision) {
+			apierror.WriteDetails(w, r, http.StatusUnprocessableEntity, apierror.CodeInvalidSum, "sum has more than two decimal places",
+				map[string]interface{}{"max_decimals": 2})
+			return
 		}
-		orderParsed, err := strconv.Atoi(orderToWithdrawReq.IDOrder)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "NewWithdraw.strconv.Atoi(orderToWithdrawReq.IDOrder)",
-			}).Error(err)
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "NewWithdraw.json.Unmarshal(body, &orderToWithdrawReq)",
+			}).Info(err)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "the body must be a JSON object with order and sum")
 			return
 		}
-		if !orders.CheckOrderID(orderParsed) {
-			log.WithFields(log.Fields{
-				"func": "NewWithdraw.CRC failed",
-			}).Error(err)
-			w.WriteHeader(http.StatusUnprocessableEntity)
+		if code, message := validateWithdraw(validator, &orderToWithdrawReq); code != "" {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "NewWithdraw.validateWithdraw",
+			}).Info(message)
+			apierror.Write(w, r, http.StatusUnprocessableEntity, code, message)
+			return
+		}
+		isBalance, result, err := store.NewWithdraw(r.Context(), &orderToWithdrawReq, &userID)
+		if err == storage.ErrWithdrawalExists {
+			apierror.Write(w, r, http.StatusConflict, apierror.CodeWithdrawalExists, "a withdrawal for this order number was already made")
+			return
 		}
-		isBalance, result, err := storage.NewWithdraw(configRun, &orderToWithdrawReq, &userID)
 		if err != nil || !result {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "NewWithdraw.storage.NewWithdraw",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
 		if !isBalance {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "NewWithdraw.balance",
 			}).Info()
-			w.WriteHeader(http.StatusPaymentRequired)
+			apierror.Write(w, r, http.StatusPaymentRequired, apierror.CodeInsufficientFunds, "not enough points on the balance")
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func GetWithdrawalsList(configRun *config.Config) func(w http.ResponseWriter, r *http.Request) {
+// validateWithdraw returns the error code and message for the first problem found in the request
+func validateWithdraw(validator orders.OrderValidator, withdraw *storage.OrderToWithdrawStruct) (code apierror.Code, message string) {
+	if err := validator.Validate(withdraw.IDOrder); err != nil {
+		return orderValidationError(err)
+	}
+	if withdraw.Sum <= 0 {
+		return apierror.CodeInvalidSum, "sum must be positive"
+	}
+	return
+}
+
+// orderValidationError maps an OrderValidator error to the error code and message of the answer
+func orderValidationError(err error) (code apierror.Code, message string) {
+	switch {
+	case errors.Is(err, orders.ErrNotNumber):
+		return apierror.CodeOrderNotNumber, orders.ErrNotNumber.Error()
+	case errors.Is(err, orders.ErrChecksum):
+		return apierror.CodeOrderChecksumInvalid, orders.ErrChecksum.Error()
+	}
+	return apierror.CodeOrderFormatInvalid, err.Error()
+}
+
+func GetWithdrawalsList(configRun *config.Config, store storage.Store) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		_, claims, _ := jwtauth.FromContext(r.Context())
 		userID := int((claims["id_user"]).(float64))
-		isWithdraws, arrWithdraws, err := storage.ReturnWithdrawsInfoByUserID(configRun, &userID)
+		filter, ok := parseListFilter(configRun, w, r, false)
+		if !ok {
+			return
+		}
+		isWithdraws, arrWithdraws, page, err := store.ReturnWithdrawsInfoByUserID(r.Context(), &userID, filter)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "GetWithdrawalsList.ReturnWithdrawsInfoByUserID",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
+		writePageHeaders(w, page)
 		if !isWithdraws {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 		withdrawsJSON, err := json.Marshal(arrWithdraws)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"func": "GetWithdrawalsList.json.Marshal(arrWithdraws)",
 			}).Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Internal(w, r)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write(withdrawsJSON)
 	}
 }
+
+// AccrualCallback accepts order updates pushed by the accrual system, the request is signed with
+// X-Signature: sha256=hex(HMAC-SHA256(secret, X-Timestamp + "." + body)), X-Timestamp is unix seconds
+func AccrualCallback(configRun *config.Config, store storage.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "AccrualCallback ioutil.ReadAll(r.Body)",
+			}).Error(err)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read the request body")
+			return
+		}
+		if !validCallbackSignature(configRun, r.Header.Get("X-Timestamp"), r.Header.Get("X-Signature"), body) {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "AccrualCallback bad signature",
+			}).Warn()
+			apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeInvalidSignature, "bad or stale signature")
+			return
+		}
+		var orderAccrual storage.UsingAccrualStruct
+		if err = json.Unmarshal(body, &orderAccrual); err != nil || orderAccrual.Order == "" {
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "AccrualCallback json.Unmarshal(body, &orderAccrual)",
+			}).Info(err)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "the body must be a JSON object with order, status and accrual")
+			return
+		}
+		err = store.UpdateOrderAccrual(r.Context(), &orderAccrual)
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusOK)
+		case errors.Is(err, storage.ErrNotFound):
+			apierror.Write(w, r, http.StatusNotFound, apierror.CodeOrderNotFound, "unknown order")
+		case errors.Is(err, storage.ErrIllegalTransition):
+			apierror.Write(w, r, http.StatusConflict, apierror.CodeIllegalTransition, "the order can't move to this status")
+		case errors.Is(err, storage.ErrNegativeAccrual):
+			apierror.Write(w, r, http.StatusUnprocessableEntity, apierror.CodeInvalidAccrual, "accrual can't be negative")
+		default:
+			logging.FromContext(r.Context()).WithFields(log.Fields{
+				"func": "AccrualCallback.UpdateOrderAccrual",
+			}).Error(err)
+			apierror.Internal(w, r)
+		}
+	}
+}
+
+func validCallbackSignature(configRun *config.Config, timestamp string, signature string, body []byte) bool {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > configRun.AccrualCallbackTolerance || -skew > configRun.AccrualCallbackTolerance {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(configRun.AccrualCallbackSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valentinaskakun/gophermart/internal/apierror"
+	"github.com/valentinaskakun/gophermart/internal/auth"
+	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/money"
+	"github.com/valentinaskakun/gophermart/internal/orders"
+	"github.com/valentinaskakun/gophermart/internal/storage"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/go-chi/jwtauth/v5"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	var configRun config.Config
+	if err := env.Parse(&configRun); err != nil {
+		t.Fatal(err)
+	}
+	configRun.StorageType = "memory"
+	configRun.JWTSecret = "test-secret-test-secret-test-secret"
+	// the lowest bcrypt cost keeps hundreds of registrations fast
+	configRun.PasswordCost = 4
+	return &configRun
+}
+
+func testTokens(t *testing.T, configRun *config.Config) *auth.TokenManager {
+	t.Helper()
+	tokens, err := auth.NewTokenManager(configRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+// decodeError reads the apierror envelope of a failed response
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) apierror.Response {
+	t.Helper()
+	var response apierror.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("status %d body %q is not an error envelope: %v", rec.Code, rec.Body.String(), err)
+	}
+	return response
+}
+
+// countingRecorder fails the test when a handler writes the status line more than once
+type countingRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (rec *countingRecorder) WriteHeader(status int) {
+	rec.writes++
+	rec.ResponseRecorder.WriteHeader(status)
+}
+
+func serve(t *testing.T, handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := &countingRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler(rec, r)
+	if rec.writes != 1 {
+		t.Fatalf("%s %s wrote the status %d times, want once", r.Method, r.URL.Path, rec.writes)
+	}
+	return rec.ResponseRecorder
+}
+
+func TestRegisterConcurrent(t *testing.T) {
+	const users = 200
+	configRun := testConfig(t)
+	tokens := testTokens(t, configRun)
+	store := storage.NewMemoryStorage()
+	register := Register(configRun, store, tokens)
+
+	ids := make([]int, users)
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"login":"user-%d","password":"secret"}`, i)
+			rec := httptest.NewRecorder()
+			register(rec, httptest.NewRequest(http.MethodPost, "/api/user/register", strings.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Errorf("register user-%d: status %d, body %s", i, rec.Code, rec.Body.String())
+				return
+			}
+			var session tokenResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil {
+				t.Errorf("register user-%d: %v", i, err)
+				return
+			}
+			token, err := tokens.Parse(session.AccessToken)
+			if err != nil {
+				t.Errorf("register user-%d: %v", i, err)
+				return
+			}
+			userID, _ := token.Get("id_user")
+			ids[i] = int(userID.(float64))
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	seen := make(map[int]int, users)
+	for i, id := range ids {
+		if other, ok := seen[id]; ok {
+			t.Fatalf("user-%d and user-%d got the same id %d", other, i, id)
+		}
+		seen[id] = i
+	}
+
+	rec := serve(t, register, httptest.NewRequest(http.MethodPost, "/api/user/register",
+		strings.NewReader(`{"login":"user-7","password":"other"}`)))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate login: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if code := decodeError(t, rec).Code; code != apierror.CodeLoginExists {
+		t.Fatalf("duplicate login: code %q, want %q", code, apierror.CodeLoginExists)
+	}
+}
+
+// signedCallback builds an accrual callback request signed the way validCallbackSignature expects
+func signedCallback(configRun *config.Config, body string) *http.Request {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(configRun.AccrualCallbackSecret))
+	mac.Write([]byte(timestamp + "." + body))
+	r := httptest.NewRequest(http.MethodPost, "/internal/accrual/callback", strings.NewReader(body))
+	r.Header.Set("X-Timestamp", timestamp)
+	r.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestAccrualCallbackRedelivery(t *testing.T) {
+	configRun := testConfig(t)
+	configRun.AccrualCallbackSecret = "callback-secret"
+	store := storage.NewMemoryStorage()
+	err := store.InsertOrder(context.Background(), &storage.UsingOrderStruct{
+		Number:     "79927398713",
+		IDUser:     1,
+		State:      storage.OrderStateNew,
+		UploadedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := AccrualCallback(configRun, store)
+	processed := `{"order":"79927398713","status":"PROCESSED","accrual":10}`
+	before := storage.IllegalTransitions()
+	for i := 0; i < 2; i++ {
+		if rec := serve(t, callback, signedCallback(configRun, processed)); rec.Code != http.StatusOK {
+			t.Fatalf("delivery %d: status %d, body %s", i+1, rec.Code, rec.Body.String())
+		}
+	}
+	if storage.IllegalTransitions() != before {
+		t.Fatalf("redelivered PROCESSED was counted as an illegal transition")
+	}
+	rec := serve(t, callback, signedCallback(configRun, `{"order":"79927398713","status":"INVALID"}`))
+	if rec.Code != http.StatusConflict || decodeError(t, rec).Code != apierror.CodeIllegalTransition {
+		t.Fatalf("PROCESSED -> INVALID: status %d, body %s", rec.Code, rec.Body.String())
+	}
+	rec = serve(t, callback, signedCallback(configRun, `{"order":"79927398713","status":"PROCESSED","accrual":-4}`))
+	if rec.Code != http.StatusUnprocessableEntity || decodeError(t, rec).Code != apierror.CodeInvalidAccrual {
+		t.Fatalf("negative accrual: status %d, body %s", rec.Code, rec.Body.String())
+	}
+}
+
+// withUser authenticates r the way the Verifier and Authenticator middlewares would
+func withUser(t *testing.T, tokens *auth.TokenManager, r *http.Request, userID int, login string) *http.Request {
+	t.Helper()
+	tokenString, _, err := tokens.Issue(userID, login, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.Parse(tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.WithContext(jwtauth.NewContext(r.Context(), token, nil))
+}
+
+// fundedUser registers a user and credits amount through a processed order
+func fundedUser(t *testing.T, store storage.Store, login string, amount money.Amount) int {
+	t.Helper()
+	ctx := context.Background()
+	userID, err := store.InsertUser(ctx, &storage.CredUserStruct{Login: login, Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	number := "4561261212345467"
+	err = store.InsertOrder(ctx, &storage.UsingOrderStruct{
+		Number:     number,
+		IDUser:     userID,
+		State:      storage.OrderStateNew,
+		UploadedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.UpdateOrderAccrual(ctx, &storage.UsingAccrualStruct{Order: number, Status: storage.OrderStateProcessed, Accrual: amount})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+func TestNewWithdraw(t *testing.T) {
+	configRun := testConfig(t)
+	tokens := testTokens(t, configRun)
+	validator, err := orders.NewValidator(configRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemoryStorage()
+	userID := fundedUser(t, store, "buyer", 100*money.Scale)
+	withdraw := NewWithdraw(configRun, store, validator)
+
+	// the cases share one account and run in order: the repeated order relies on the successful one
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   apierror.Code
+	}{
+		{name: "malformed body", body: `{"order":`, wantStatus: http.StatusBadRequest, wantCode: apierror.CodeBadRequest},
+		{name: "non-digit order", body: `{"order":"7992a398713","sum":1}`, wantStatus: http.StatusUnprocessableEntity, wantCode: apierror.CodeOrderNotNumber},
+		{name: "luhn failure", body: `{"order":"79927398710","sum":1}`, wantStatus: http.StatusUnprocessableEntity, wantCode: apierror.CodeOrderChecksumInvalid},
+		{name: "zero sum", body: `{"order":"79927398713","sum":0}`, wantStatus: http.StatusUnprocessableEntity, wantCode: apierror.CodeInvalidSum},
+		{name: "negative sum", body: `{"order":"79927398713","sum":-5}`, wantStatus: http.StatusUnprocessableEntity, wantCode: apierror.CodeInvalidSum},
+		{name: "three decimals", body: `{"order":"79927398713","sum":1.005}`, wantStatus: http.StatusUnprocessableEntity, wantCode: apierror.CodeInvalidSum},
+		{name: "insufficient funds", body: `{"order":"12345678903","sum":100.01}`, wantStatus: http.StatusPaymentRequired, wantCode: apierror.CodeInsufficientFunds},
+		{name: "success", body: `{"order":"79927398713","sum":40.5}`, wantStatus: http.StatusOK},
+		{name: "repeated order", body: `{"order":"79927398713","sum":1}`, wantStatus: http.StatusConflict, wantCode: apierror.CodeWithdrawalExists},
+		{name: "repeated order above the balance", body: `{"order":"79927398713","sum":60}`, wantStatus: http.StatusConflict, wantCode: apierror.CodeWithdrawalExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(tt.body))
+			rec := serve(t, withdraw, withUser(t, tokens, r, userID, "buyer"))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantCode == "" {
+				if rec.Body.Len() != 0 {
+					t.Fatalf("unexpected body %s", rec.Body.String())
+				}
+				return
+			}
+			if code := decodeError(t, rec).Code; code != tt.wantCode {
+				t.Fatalf("code %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+
+	balance, err := store.ReturnBalanceByUserID(context.Background(), &userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Current != 5950 || balance.Withdrawn != 4050 {
+		t.Fatalf("balance current %s withdrawn %s, want 59.5 and 40.5", balance.Current, balance.Withdrawn)
+	}
+}
+
+func TestGetOrdersListQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxLimit    int
+		query       string
+		wantStatus  int
+		wantParam   string
+		wantMessage string
+	}{
+		{name: "unbounded zero limit", maxLimit: 0, query: "limit=0", wantStatus: http.StatusBadRequest, wantParam: "limit", wantMessage: "limit must be a positive number"},
+		{name: "unbounded large limit", maxLimit: 0, query: "limit=100000", wantStatus: http.StatusNoContent},
+		{name: "bounded zero limit", maxLimit: 1000, query: "limit=0", wantStatus: http.StatusBadRequest, wantParam: "limit", wantMessage: "limit must be a number from 1 to 1000"},
+		{name: "bounded non-number limit", maxLimit: 1000, query: "limit=ten", wantStatus: http.StatusBadRequest, wantParam: "limit", wantMessage: "limit must be a number from 1 to 1000"},
+		{name: "limit over max", maxLimit: 1000, query: "limit=1001", wantStatus: http.StatusBadRequest, wantParam: "limit", wantMessage: "limit must be a number from 1 to 1000"},
+		{name: "from after to", maxLimit: 1000, query: "from=2026-02-01T00:00:00Z&to=2026-01-01T00:00:00Z", wantStatus: http.StatusBadRequest, wantParam: "from", wantMessage: "from must be before to"},
+		{name: "from equals to", maxLimit: 1000, query: "from=2026-01-01T00:00:00Z&to=2026-01-01T00:00:00Z", wantStatus: http.StatusBadRequest, wantParam: "from", wantMessage: "from must be before to"},
+		{name: "valid range", maxLimit: 1000, query: "from=2026-01-01T00:00:00Z&to=2026-02-01T00:00:00Z", wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configRun := testConfig(t)
+			configRun.ListMaxLimit = tt.maxLimit
+			tokens := testTokens(t, configRun)
+			list := GetOrdersList(configRun, storage.NewMemoryStorage())
+			r := httptest.NewRequest(http.MethodGet, "/api/user/orders?"+tt.query, nil)
+			rec := serve(t, list, withUser(t, tokens, r, 1, "buyer"))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantParam == "" {
+				return
+			}
+			response := decodeError(t, rec)
+			if response.Code != apierror.CodeInvalidQuery || response.Details["param"] != tt.wantParam || response.Message != tt.wantMessage {
+				t.Fatalf("got %+v, want invalid_query for %s: %s", response, tt.wantParam, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestUploadOrdersBatchBodyLimit(t *testing.T) {
+	configRun := testConfig(t)
+	configRun.OrderBatchLimit = 2
+	tokens := testTokens(t, configRun)
+	validator, err := orders.NewValidator(configRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := UploadOrdersBatch(configRun, storage.NewMemoryStorage(), validator)
+
+	body := strings.NewReader(strings.Repeat("79927398713\n", 100000))
+	r := httptest.NewRequest(http.MethodPost, "/api/user/orders/batch", body)
+	r.Header.Set("Content-Type", "text/plain")
+	rec := serve(t, upload, withUser(t, tokens, r, 1, "buyer"))
+	if rec.Code != http.StatusRequestEntityTooLarge || decodeError(t, rec).Code != apierror.CodeBatchTooLarge {
+		t.Fatalf("oversized body: status %d, body %s", rec.Code, rec.Body.String())
+	}
+	if body.Len() == 0 {
+		t.Fatal("the whole oversized body was read")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/api/user/orders/batch", strings.NewReader(`["79927398713", "12345678903"]`))
+	r.Header.Set("Content-Type", "application/json")
+	if rec = serve(t, upload, withUser(t, tokens, r, 1, "buyer")); rec.Code != http.StatusOK {
+		t.Fatalf("batch within the limit: status %d, body %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,36 @@
+// Package logging carries a request-scoped logrus entry through the context, so every line logged
+// while serving a request has the request_id the client sees in X-Request-Id and in error envelopes
+package logging
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	log "github.com/sirupsen/logrus"
+)
+
+type entryKey struct{}
+
+// Middleware must run after middleware.RequestID, it echoes the id in X-Request-Id
+// and stores an entry with the request_id field in the request context
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := middleware.GetReqID(r.Context())
+		if requestID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(middleware.RequestIDHeader, requestID)
+		entry := log.WithField("request_id", requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), entryKey{}, entry)))
+	})
+}
+
+// FromContext returns the request entry or the standard logger outside of a request
+func FromContext(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(entryKey{}).(*log.Entry); ok {
+		return entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
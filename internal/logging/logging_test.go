@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestMiddlewareCarriesRequestID(t *testing.T) {
+	hook := test.NewGlobal()
+	handler := middleware.RequestID(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Warn("inside the handler")
+		w.WriteHeader(http.StatusInternalServerError)
+	})))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	requestID := rec.Header().Get("X-Request-Id")
+	if requestID == "" {
+		t.Fatal("X-Request-Id isn't set on the response")
+	}
+	entry := hook.LastEntry()
+	if entry == nil || entry.Data["request_id"] != requestID {
+		t.Fatalf("log entry %v doesn't carry request_id %s", entry, requestID)
+	}
+}
+
+func TestFromContextWithoutRequest(t *testing.T) {
+	if entry := FromContext(context.Background()); entry == nil || len(entry.Data) != 0 {
+		t.Fatalf("FromContext outside a request = %v, want a bare entry", entry)
+	}
+}
@@ -0,0 +1,117 @@
+package money
+
+import (
+	"database/sql/driver"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Scale is the number of minor units in one point, amounts keep two decimal places exactly
+const Scale = 100
+
+// Amount is a number of loyalty points stored as integer hundredths
+type Amount int64
+
+var (
+	ErrPrecision = errors.New("amount has more than two decimal places")
+	// ErrFormat is wrapped by every other Parse failure: not a decimal number or out of range
+	ErrFormat = errors.New("malformed amount")
+)
+
+// Parse converts a decimal string such as "729.98" into an Amount without going through float64
+func Parse(value string) (amount Amount, err error) {
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	digits := strings.TrimPrefix(value, "-")
+	intPart, fracPart := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		intPart, fracPart = digits[:i], digits[i+1:]
+	}
+	if intPart == "" || !isDigits(intPart) || !isDigits(fracPart) || (strings.Contains(digits, ".") && fracPart == "") {
+		return 0, errors.Wrapf(ErrFormat, "bad amount %q", value)
+	}
+	fracPart = strings.TrimRight(fracPart, "0")
+	if len(fracPart) > 2 {
+		return 0, ErrPrecision
+	}
+	fracPart += strings.Repeat("0", 2-len(fracPart))
+	cents, _ := strconv.ParseInt(fracPart, 10, 64)
+	units, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil || units > (math.MaxInt64-cents)/Scale {
+		return 0, errors.Wrapf(ErrFormat, "amount %q is out of range", value)
+	}
+	amount = Amount(units*Scale + cents)
+	if negative {
+		amount = -amount
+	}
+	return
+}
+
+func isDigits(value string) bool {
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount the way encoding/json formats the equivalent float64: 42, 500.5, 729.98
+func (a Amount) String() string {
+	sign := ""
+	minor := int64(a)
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	units, cents := minor/Scale, minor%Scale
+	if cents == 0 {
+		return sign + strconv.FormatInt(units, 10)
+	}
+	frac := strings.TrimRight(strconv.FormatInt(cents+Scale, 10)[1:], "0")
+	return sign + strconv.FormatInt(units, 10) + "." + frac
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) (err error) {
+	value := string(data)
+	if value == "null" {
+		return nil
+	}
+	*a, err = Parse(strings.Trim(value, `"`))
+	return
+}
+
+func (a Amount) Value() (driver.Value, error) {
+	return int64(a), nil
+}
+
+func (a *Amount) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*a = 0
+	case int64:
+		*a = Amount(value)
+	case []byte:
+		minor, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return err
+		}
+		*a = Amount(minor)
+	case string:
+		minor, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*a = Amount(minor)
+	default:
+		return errors.Errorf("can't scan %T into money.Amount", src)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Amount
+		wantErr bool
+	}{
+		{value: "0", want: 0},
+		{value: "42", want: 4200},
+		{value: "500.5", want: 50050},
+		{value: "729.98", want: 72998},
+		{value: "0.01", want: 1},
+		{value: "1.10", want: 110},
+		{value: "1.000", want: 100},
+		{value: " 7 ", want: 700},
+		{value: "-4", want: -400},
+		{value: "-0.5", want: -50},
+		{value: "92233720368547758.07", want: math.MaxInt64},
+		{value: "92233720368547758.08", wantErr: true},
+		{value: "92233720368547758.99", wantErr: true},
+		{value: "92233720368547759", wantErr: true},
+		{value: "99999999999999999999", wantErr: true},
+		{value: "", wantErr: true},
+		{value: "-", wantErr: true},
+		{value: ".5", wantErr: true},
+		{value: "5.", wantErr: true},
+		{value: "1e3", wantErr: true},
+		{value: "1.2.3", wantErr: true},
+		{value: "+1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := Parse(tt.value)
+			if tt.wantErr {
+				if !errors.Is(err, ErrFormat) {
+					t.Fatalf("Parse(%q) = %d, %v, want ErrFormat", tt.value, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	for _, value := range []string{"0.001", "1.234", "-5.555"} {
+		if _, err := Parse(value); !errors.Is(err, ErrPrecision) {
+			t.Errorf("Parse(%q) error = %v, want ErrPrecision", value, err)
+		}
+	}
+}
+
+// TestStringMatchesFloatJSON checks that amounts are written exactly like encoding/json writes the float64
+// they used to be stored as, so API responses stay byte-compatible
+func TestStringMatchesFloatJSON(t *testing.T) {
+	for _, minor := range []int64{0, 1, 10, 99, 100, 4200, 50050, 72998, 123456789, -1, -50, -72998} {
+		amount := Amount(minor)
+		floatJSON, err := json.Marshal(float64(minor) / Scale)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amountJSON, err := json.Marshal(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(amountJSON) != string(floatJSON) {
+			t.Errorf("json.Marshal(Amount(%d)) = %s, float64 gives %s", minor, amountJSON, floatJSON)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, minor := range []int64{0, 1, 9, 10, 11, 99, 100, 101, 72998, -72998, math.MaxInt64, -math.MaxInt64} {
+		amount := Amount(minor)
+		parsed, err := Parse(amount.String())
+		if err != nil {
+			t.Fatalf("Parse(%q) error: %v", amount.String(), err)
+		}
+		if parsed != amount {
+			t.Errorf("Parse(Amount(%d).String()) = %d", minor, parsed)
+		}
+		var decoded Amount
+		data, _ := json.Marshal(amount)
+		if err = json.Unmarshal(data, &decoded); err != nil || decoded != amount {
+			t.Errorf("json round trip of %d gave %d, %v", minor, decoded, err)
+		}
+		if err = json.Unmarshal([]byte(strconv.Quote(amount.String())), &decoded); err != nil || decoded != amount {
+			t.Errorf("quoted json round trip of %d gave %d, %v", minor, decoded, err)
+		}
+	}
+}
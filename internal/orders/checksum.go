@@ -0,0 +1,85 @@
+package orders
+
+// Checksum algorithms known to NewValidator, "none" accepts any digits
+const (
+	ChecksumLuhn     = "luhn"
+	ChecksumVerhoeff = "verhoeff"
+	ChecksumDamm     = "damm"
+	ChecksumNone     = "none"
+)
+
+var verhoeffMultiplication = [10][10]int{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+	{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+	{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+	{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+	{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+	{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+	{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+	{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+	{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+}
+
+var verhoeffPermutation = [8][10]int{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+	{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+	{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+	{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+	{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+	{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+	{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+}
+
+var dammQuasigroup = [10][10]int{
+	{0, 3, 1, 7, 5, 9, 8, 6, 4, 2},
+	{7, 0, 9, 2, 1, 5, 4, 8, 6, 3},
+	{4, 2, 0, 6, 8, 7, 1, 3, 5, 9},
+	{1, 7, 5, 0, 9, 8, 3, 4, 2, 6},
+	{6, 1, 2, 3, 0, 4, 5, 9, 7, 8},
+	{3, 6, 7, 4, 2, 0, 9, 5, 8, 1},
+	{5, 8, 6, 9, 7, 2, 0, 1, 3, 4},
+	{8, 9, 4, 5, 3, 6, 2, 0, 1, 7},
+	{9, 4, 3, 8, 6, 1, 7, 2, 0, 5},
+	{2, 5, 8, 1, 4, 3, 6, 7, 9, 0},
+}
+
+// CheckVerhoeff reports whether the last digit of number is its Verhoeff check digit
+func CheckVerhoeff(number string) bool {
+	if !IsDigits(number) {
+		return false
+	}
+	check := 0
+	for i := 0; i < len(number); i++ {
+		digit := int(number[len(number)-1-i] - '0')
+		check = verhoeffMultiplication[check][verhoeffPermutation[i%8][digit]]
+	}
+	return check == 0
+}
+
+// CheckDamm reports whether the last digit of number is its Damm check digit
+func CheckDamm(number string) bool {
+	if !IsDigits(number) {
+		return false
+	}
+	interim := 0
+	for i := 0; i < len(number); i++ {
+		interim = dammQuasigroup[interim][number[i]-'0']
+	}
+	return interim == 0
+}
+
+func checksumFunc(name string) (func(string) bool, bool) {
+	switch name {
+	case ChecksumLuhn, "":
+		return CheckOrderID, true
+	case ChecksumVerhoeff:
+		return CheckVerhoeff, true
+	case ChecksumDamm:
+		return CheckDamm, true
+	case ChecksumNone:
+		return IsDigits, true
+	}
+	return nil, false
+}
@@ -0,0 +1,51 @@
+package orders
+
+import "testing"
+
+func TestChecksums(t *testing.T) {
+	tests := []struct {
+		checksum string
+		number   string
+		want     bool
+	}{
+		{checksum: ChecksumLuhn, number: "79927398713", want: true},
+		{checksum: ChecksumLuhn, number: "4561261212345467", want: true},
+		{checksum: ChecksumLuhn, number: "79927398710", want: false},
+		{checksum: ChecksumLuhn, number: "97927398713", want: false},
+		{checksum: ChecksumVerhoeff, number: "2363", want: true},
+		{checksum: ChecksumVerhoeff, number: "123451", want: true},
+		{checksum: ChecksumVerhoeff, number: "412345675", want: true},
+		{checksum: ChecksumVerhoeff, number: "2364", want: false},
+		{checksum: ChecksumVerhoeff, number: "3263", want: false},
+		{checksum: ChecksumVerhoeff, number: "12a451", want: false},
+		{checksum: ChecksumVerhoeff, number: "", want: false},
+		{checksum: ChecksumDamm, number: "5724", want: true},
+		{checksum: ChecksumDamm, number: "771234564", want: true},
+		{checksum: ChecksumDamm, number: "5727", want: false},
+		{checksum: ChecksumDamm, number: "7524", want: false},
+		{checksum: ChecksumDamm, number: "57a4", want: false},
+		{checksum: ChecksumDamm, number: "", want: false},
+		{checksum: ChecksumNone, number: "1234", want: true},
+		{checksum: ChecksumNone, number: "12x4", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.checksum+"/"+tt.number, func(t *testing.T) {
+			check, ok := checksumFunc(tt.checksum)
+			if !ok {
+				t.Fatalf("checksum %q isn't known", tt.checksum)
+			}
+			if got := check(tt.number); got != tt.want {
+				t.Errorf("%s(%q) = %v, want %v", tt.checksum, tt.number, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChecksumUnknown(t *testing.T) {
+	if _, ok := checksumFunc("crc32"); ok {
+		t.Fatal("unknown checksum was accepted")
+	}
+	if _, ok := checksumFunc(""); !ok {
+		t.Fatal("empty checksum should default to Luhn")
+	}
+}
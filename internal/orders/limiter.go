@@ -0,0 +1,96 @@
+package orders
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by all accrual workers, the rate can be changed
+// on the fly when the accrual system tells us its limit in a 429 response
+type RateLimiter struct {
+	mu          sync.Mutex
+	perSecond   float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// NewRateLimiter allows perMinute requests per minute, 0 means no limit until SetPerMinute is called
+func NewRateLimiter(perMinute int) *RateLimiter {
+	l := &RateLimiter{last: time.Now()}
+	l.SetPerMinute(perMinute)
+	l.tokens = l.burst
+	return l
+}
+
+func (l *RateLimiter) SetPerMinute(perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.perSecond = float64(perMinute) / 60
+	l.burst = float64(perMinute) / 10
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// PauseUntil blocks every Wait call until t, used for the Retry-After header
+func (l *RateLimiter) PauseUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.pausedUntil) {
+		l.pausedUntil = t
+	}
+	l.tokens = 0
+	l.last = l.pausedUntil
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if l.perSecond > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.perSecond
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// reserve takes a token if possible, otherwise it returns how long to wait before trying again
+func (l *RateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.perSecond == 0 {
+		return 0
+	}
+	l.refill(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.perSecond * float64(time.Second))
+}
+
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := l.reserve()
+		if delay == 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package orders
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/money"
+	"github.com/valentinaskakun/gophermart/internal/storage"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+)
+
+// reRateLimit matches the 429 body of the accrual system: "No more than N requests per minute allowed"
+var reRateLimit = regexp.MustCompile(`No more than (\d+) requests per minute`)
+
+// Processor polls the accrual system for unfinished orders with a pool of workers,
+// all workers share one rate limiter and failing orders are retried with exponential backoff.
+// Orders are claimed from the storage queue, so several instances can run side by side
+type Processor struct {
+	store       storage.Store
+	client      *resty.Client
+	limiter     *RateLimiter
+	workerID    string
+	workers     int
+	interval    time.Duration
+	lease       time.Duration
+	backoffBase time.Duration
+	backoffMax  time.Duration
+
+	mu   sync.Mutex
+	busy int
+}
+
+func NewProcessor(configRun *config.Config, store storage.Store) *Processor {
+	baseURL := configRun.AccrualAddress
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	workers := configRun.AccrualWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	hostname, _ := os.Hostname()
+	return &Processor{
+		store: store,
+		client: resty.New().
+			SetBaseURL(baseURL).
+			SetTimeout(configRun.AccrualRequestTimeout).
+			SetHeader("Content-Type", "application/json"),
+		limiter:     NewRateLimiter(configRun.AccrualRateLimit),
+		workerID:    fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		workers:     workers,
+		interval:    configRun.AccrualPollInterval,
+		lease:       configRun.AccrualLease,
+		backoffBase: configRun.AccrualBackoffBase,
+		backoffMax:  configRun.AccrualBackoffMax,
+	}
+}
+
+// Run polls until ctx is cancelled and waits for the workers to finish their current order
+func (p *Processor) Run(ctx context.Context) {
+	jobs := make(chan storage.QueuedOrderStruct, p.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for order := range jobs {
+				p.process(ctx, order)
+				p.mu.Lock()
+				p.busy--
+				p.mu.Unlock()
+			}
+		}()
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.dispatch(ctx, jobs)
+		select {
+		case <-ctx.Done():
+			close(jobs)
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch claims as many due orders as there are idle workers and hands them out
+func (p *Processor) dispatch(ctx context.Context, jobs chan<- storage.QueuedOrderStruct) {
+	p.mu.Lock()
+	idle := p.workers - p.busy
+	p.mu.Unlock()
+	if idle <= 0 || ctx.Err() != nil {
+		return
+	}
+	arrOrders, err := p.store.ClaimOrders(ctx, p.workerID, idle, p.lease)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "Processor.dispatch.ClaimOrders",
+		}).Error(err)
+		return
+	}
+	for _, order := range arrOrders {
+		p.mu.Lock()
+		p.busy++
+		p.mu.Unlock()
+		jobs <- order
+	}
+}
+
+// process fetches and applies one order, when ctx is cancelled before the answer arrives the order
+// is handed back with a fresh context so another instance doesn't have to wait for the lease to expire
+func (p *Processor) process(ctx context.Context, order storage.QueuedOrderStruct) {
+	if err := p.limiter.Wait(ctx); err != nil {
+		p.release(context.Background(), order, 0)
+		return
+	}
+	orderNum := order.IDOrder
+	resp, err := p.client.R().SetContext(ctx).Get("/api/orders/" + orderNum)
+	if err != nil {
+		if ctx.Err() != nil {
+			p.release(context.Background(), order, 0)
+			return
+		}
+		log.WithFields(log.Fields{
+			"func": "Processor.process something went wrong while GET accrual for " + orderNum,
+		}).Warn(err)
+		p.retryLater(ctx, order)
+		return
+	}
+	// the answer is in hand, so it is written even if shutdown starts now: the store bounds every
+	// write with DB_WRITE_TIMEOUT and main waits for the workers up to SHUTDOWN_TIMEOUT
+	ctx = context.Background()
+	switch status := resp.StatusCode(); {
+	case status == http.StatusOK:
+		var orderToAccrual storage.UsingAccrualStruct
+		err = json.Unmarshal(resp.Body(), &orderToAccrual)
+		if errors.Is(err, money.ErrPrecision) || errors.Is(err, money.ErrFormat) {
+			// the accrual system answers the same amount on every attempt, retrying it would never end
+			log.WithFields(log.Fields{
+				"func": "Processor.process accrual system answered an unusable accrual, marking INVALID " + orderNum,
+			}).Error(err)
+			orderToAccrual = storage.UsingAccrualStruct{Order: orderNum, Status: storage.OrderStateInvalid}
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"func": "Processor.process error while unmarshalling Accrual " + orderNum,
+			}).Error(err)
+			p.retryLater(ctx, order)
+			return
+		}
+		// the answer must be about the claimed order, anything else would touch another user's order
+		if orderToAccrual.Order == "" {
+			orderToAccrual.Order = orderNum
+		}
+		if orderToAccrual.Order != orderNum {
+			log.WithFields(log.Fields{
+				"func": "Processor.process accrual answered for " + orderToAccrual.Order + " instead of " + orderNum,
+			}).Error()
+			p.retryLater(ctx, order)
+			return
+		}
+		err = p.store.UpdateOrderAccrual(ctx, &orderToAccrual)
+		if errors.Is(err, storage.ErrIllegalTransition) {
+			p.release(ctx, order, p.interval)
+		} else if errors.Is(err, storage.ErrNegativeAccrual) {
+			log.WithFields(log.Fields{
+				"func": "Processor.process accrual system answered a negative accrual for " + orderNum,
+			}).Error(err)
+			p.retryLater(ctx, order)
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"func": "Processor.process store.UpdateOrderAccrual",
+			}).Error(err)
+			p.retryLater(ctx, order)
+		}
+	case status == http.StatusTooManyRequests:
+		p.release(ctx, order, p.throttle(resp))
+	case status == http.StatusNoContent:
+		log.WithFields(log.Fields{
+			"func": "Processor.process order isn't registered in the accrual system yet " + orderNum,
+		}).Info()
+		p.retryLater(ctx, order)
+	default:
+		log.WithFields(log.Fields{
+			"func": "Processor.process unexpected StatusCode " + strconv.Itoa(status) + " for " + orderNum,
+		}).Warn()
+		p.retryLater(ctx, order)
+	}
+}
+
+// throttle pauses all workers for Retry-After and lowers the shared rate to the limit named in the body
+func (p *Processor) throttle(resp *resty.Response) (retryAfter time.Duration) {
+	retryAfter = time.Minute
+	if seconds, err := strconv.Atoi(strings.TrimSpace(resp.Header().Get("Retry-After"))); err == nil && seconds >= 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(resp.Header().Get("Retry-After")); err == nil {
+		retryAfter = time.Until(at)
+	}
+	if match := reRateLimit.FindSubmatch(resp.Body()); match != nil {
+		if perMinute, err := strconv.Atoi(string(match[1])); err == nil && perMinute > 0 {
+			p.limiter.SetPerMinute(perMinute)
+		}
+	}
+	log.WithFields(log.Fields{
+		"func": "Processor.throttle StatusTooManyRequests, pause for " + retryAfter.String(),
+	}).Warn()
+	p.limiter.PauseUntil(time.Now().Add(retryAfter))
+	return
+}
+
+// retryLater schedules the next attempt for the order after base * 2^attempts, capped by backoffMax
+func (p *Processor) retryLater(ctx context.Context, order storage.QueuedOrderStruct) {
+	delay := p.backoffMax
+	if order.Attempts < 32 {
+		delay = p.backoffBase << order.Attempts
+	}
+	if delay <= 0 || delay > p.backoffMax {
+		delay = p.backoffMax
+	}
+	if err := p.store.RetryOrder(ctx, order.IDOrder, p.workerID, delay); err != nil {
+		log.WithFields(log.Fields{
+			"func": "Processor.retryLater.RetryOrder",
+		}).Error(err)
+	}
+}
+
+// release hands the order back to the queue without counting a failed attempt
+func (p *Processor) release(ctx context.Context, order storage.QueuedOrderStruct, delay time.Duration) {
+	if err := p.store.ReleaseOrder(ctx, order.IDOrder, p.workerID, delay); err != nil {
+		log.WithFields(log.Fields{
+			"func": "Processor.release.ReleaseOrder",
+		}).Error(err)
+	}
+}
@@ -0,0 +1,152 @@
+package orders
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/storage"
+
+	"github.com/caarlos0/env/v6"
+)
+
+// newTestProcessor points a processor at an accrual stub answering every request with body
+func newTestProcessor(t *testing.T, store storage.Store, body string) *Processor {
+	t.Helper()
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(accrual.Close)
+	var configRun config.Config
+	if err := env.Parse(&configRun); err != nil {
+		t.Fatal(err)
+	}
+	configRun.AccrualAddress = accrual.URL
+	return NewProcessor(&configRun, store)
+}
+
+func insertTestOrder(t *testing.T, store storage.Store, number string, userID int) {
+	t.Helper()
+	err := store.InsertOrder(context.Background(), &storage.UsingOrderStruct{
+		Number:     number,
+		IDUser:     userID,
+		State:      storage.OrderStateNew,
+		UploadedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func claimTestOrder(t *testing.T, p *Processor) storage.QueuedOrderStruct {
+	t.Helper()
+	arrOrders, err := p.store.ClaimOrders(context.Background(), p.workerID, 1, time.Minute)
+	if err != nil || len(arrOrders) != 1 {
+		t.Fatalf("ClaimOrders = %v, %v, want one order", arrOrders, err)
+	}
+	return arrOrders[0]
+}
+
+func orderState(t *testing.T, store storage.Store, number string) string {
+	t.Helper()
+	orderInfo, err := store.ReturnOrderInfoByID(context.Background(), number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return orderInfo.State
+}
+
+func TestProcessIgnoresAnswerForAnotherOrder(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	insertTestOrder(t, store, "79927398713", 1)
+	p := newTestProcessor(t, store, `{"order":"12345678903","status":"PROCESSED","accrual":500}`)
+	order := claimTestOrder(t, p)
+	// the other user's order is uploaded after the claim so it stays out of the queue
+	insertTestOrder(t, store, "12345678903", 2)
+
+	p.process(context.Background(), order)
+
+	if state := orderState(t, store, "12345678903"); state != storage.OrderStateNew {
+		t.Errorf("order named in the answer moved to %s", state)
+	}
+	if state := orderState(t, store, "79927398713"); state != storage.OrderStateNew {
+		t.Errorf("claimed order moved to %s on a mismatched answer", state)
+	}
+}
+
+func TestProcessFillsMissingOrderNumber(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	insertTestOrder(t, store, "79927398713", 1)
+	p := newTestProcessor(t, store, `{"status":"INVALID"}`)
+
+	p.process(context.Background(), claimTestOrder(t, p))
+
+	if state := orderState(t, store, "79927398713"); state != storage.OrderStateInvalid {
+		t.Errorf("claimed order is %s, want %s", state, storage.OrderStateInvalid)
+	}
+}
+
+// cancellingStore cancels the worker context as the answer is about to be written and, like Postgres,
+// fails writes made with a cancelled context
+type cancellingStore struct {
+	storage.Store
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStore) UpdateOrderAccrual(ctx context.Context, orderAccrual *storage.UsingAccrualStruct) error {
+	s.cancel()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.UpdateOrderAccrual(ctx, orderAccrual)
+}
+
+func (s *cancellingStore) RetryOrder(ctx context.Context, orderID string, workerID string, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.RetryOrder(ctx, orderID, workerID, delay)
+}
+
+func (s *cancellingStore) ReleaseOrder(ctx context.Context, orderID string, workerID string, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.ReleaseOrder(ctx, orderID, workerID, delay)
+}
+
+func TestProcessKeepsAnswerOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	memory := storage.NewMemoryStorage()
+	insertTestOrder(t, memory, "79927398713", 1)
+	p := newTestProcessor(t, &cancellingStore{Store: memory, cancel: cancel}, `{"order":"79927398713","status":"PROCESSED","accrual":5}`)
+	order := claimTestOrder(t, p)
+
+	p.process(ctx, order)
+
+	if state := orderState(t, memory, "79927398713"); state != storage.OrderStateProcessed {
+		t.Errorf("order is %s after shutdown during the write, want %s", state, storage.OrderStateProcessed)
+	}
+}
+
+func TestProcessMarksUnusableAccrualInvalid(t *testing.T) {
+	for _, body := range []string{
+		`{"order":"79927398713","status":"PROCESSED","accrual":500.125}`,
+		`{"order":"79927398713","status":"PROCESSED","accrual":"lots"}`,
+	} {
+		store := storage.NewMemoryStorage()
+		insertTestOrder(t, store, "79927398713", 1)
+		p := newTestProcessor(t, store, body)
+
+		p.process(context.Background(), claimTestOrder(t, p))
+
+		if state := orderState(t, store, "79927398713"); state != storage.OrderStateInvalid {
+			t.Errorf("answer %s left the order %s, want %s", body, state, storage.OrderStateInvalid)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package orders
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotNumber = errors.New("the order number must contain only digits")
+	ErrChecksum  = errors.New("the order number fails the checksum")
+	ErrLength    = errors.New("the order number has a wrong length")
+	ErrPrefix    = errors.New("the order number has an unknown prefix")
+)
+
+// OrderValidator decides whether an order number can be uploaded or used for a withdrawal,
+// the returned error wraps one of ErrNotNumber, ErrChecksum, ErrLength or ErrPrefix
+type OrderValidator interface {
+	Validate(number string) error
+}
+
+// Rule is a validation policy: a checksum algorithm plus optional length bounds and allowed prefixes
+type Rule struct {
+	Name      string   `json:"name"`
+	Checksum  string   `json:"checksum"`
+	MinLength int      `json:"min_length"`
+	MaxLength int      `json:"max_length"`
+	Prefixes  []string `json:"prefixes"`
+
+	check func(string) bool
+}
+
+func (rule *Rule) compile() error {
+	check, ok := checksumFunc(rule.Checksum)
+	if !ok {
+		return errors.Errorf("unknown checksum %q", rule.Checksum)
+	}
+	if rule.MaxLength > 0 && rule.MinLength > rule.MaxLength {
+		return errors.Errorf("min_length %d is greater than max_length %d", rule.MinLength, rule.MaxLength)
+	}
+	rule.check = check
+	return nil
+}
+
+func (rule *Rule) hasPrefix(number string) bool {
+	for _, prefix := range rule.Prefixes {
+		if strings.HasPrefix(number, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) Validate(number string) error {
+	if !IsDigits(number) {
+		return ErrNotNumber
+	}
+	if len(number) < rule.MinLength || (rule.MaxLength > 0 && len(number) > rule.MaxLength) {
+		return errors.Wrapf(ErrLength, "%s: %d digits", rule.Name, len(number))
+	}
+	if len(rule.Prefixes) > 0 && !rule.hasPrefix(number) {
+		return errors.Wrap(ErrPrefix, rule.Name)
+	}
+	if !rule.check(number) {
+		return errors.Wrapf(ErrChecksum, "%s: %s", rule.Name, rule.Checksum)
+	}
+	return nil
+}
+
+// MerchantValidator applies the rule of the first merchant whose prefix matches the number
+// and the default rule to every other number
+type MerchantValidator struct {
+	Merchants []Rule `json:"merchants"`
+	Default   Rule   `json:"-"`
+}
+
+func (v *MerchantValidator) Validate(number string) error {
+	for i := range v.Merchants {
+		if v.Merchants[i].hasPrefix(number) {
+			return v.Merchants[i].Validate(number)
+		}
+	}
+	return v.Default.Validate(number)
+}
+
+// NewValidator builds the validator from ORDER_* settings, Luhn with no other limits by default
+func NewValidator(configRun *config.Config) (OrderValidator, error) {
+	validator := &MerchantValidator{Default: Rule{
+		Name:      "default",
+		Checksum:  configRun.OrderChecksum,
+		MinLength: configRun.OrderMinLength,
+		MaxLength: configRun.OrderMaxLength,
+		Prefixes:  configRun.OrderPrefixes,
+	}}
+	if err := validator.Default.compile(); err != nil {
+		return nil, errors.Wrap(err, "default order rule")
+	}
+	if configRun.OrderMerchantRules == "" {
+		return validator, nil
+	}
+	data, err := os.ReadFile(configRun.OrderMerchantRules)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read merchant rules %s", configRun.OrderMerchantRules)
+	}
+	if err = json.Unmarshal(data, validator); err != nil {
+		return nil, errors.Wrapf(err, "parse merchant rules %s", configRun.OrderMerchantRules)
+	}
+	for i := range validator.Merchants {
+		if len(validator.Merchants[i].Prefixes) == 0 {
+			return nil, errors.Errorf("merchant rule %d has no prefixes", i)
+		}
+		if err = validator.Merchants[i].compile(); err != nil {
+			return nil, errors.Wrapf(err, "merchant rule %d", i)
+		}
+	}
+	return validator, nil
+}
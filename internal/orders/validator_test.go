@@ -0,0 +1,114 @@
+package orders
+
+import (
+	"testing"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/pkg/errors"
+)
+
+func testValidatorConfig(t *testing.T) *config.Config {
+	t.Helper()
+	var configRun config.Config
+	if err := env.Parse(&configRun); err != nil {
+		t.Fatal(err)
+	}
+	return &configRun
+}
+
+func TestValidatorMerchantRules(t *testing.T) {
+	configRun := testValidatorConfig(t)
+	configRun.OrderMerchantRules = "merchants.example.json"
+	validator, err := NewValidator(configRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		number  string
+		wantErr error
+	}{
+		{number: "79927398713"},
+		{number: "7992739871a", wantErr: ErrNotNumber},
+		{number: "79927398710", wantErr: ErrChecksum},
+		// acme: prefix 77, 10 to 12 digits, Damm
+		{number: "77123456789"},
+		{number: "77123456780", wantErr: ErrChecksum},
+		{number: "771234564", wantErr: ErrLength},
+		// globex: prefixes 41 and 42, at least 8 digits, Verhoeff
+		{number: "41000005"},
+		{number: "412345675"},
+		{number: "41000006", wantErr: ErrChecksum},
+		{number: "4100005", wantErr: ErrLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.number, func(t *testing.T) {
+			err := validator.Validate(tt.number)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Validate(%q) error: %v", tt.number, err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Validate(%q) error = %v, want %v", tt.number, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatorDefaultRule(t *testing.T) {
+	configRun := testValidatorConfig(t)
+	configRun.OrderChecksum = ChecksumVerhoeff
+	configRun.OrderMinLength = 4
+	configRun.OrderMaxLength = 6
+	configRun.OrderPrefixes = []string{"1", "2"}
+	validator, err := NewValidator(configRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		number  string
+		wantErr error
+	}{
+		{number: "2363"},
+		{number: "123451"},
+		{number: "2364", wantErr: ErrChecksum},
+		{number: "236", wantErr: ErrLength},
+		{number: "1234512", wantErr: ErrLength},
+		{number: "5724", wantErr: ErrPrefix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.number, func(t *testing.T) {
+			err := validator.Validate(tt.number)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Validate(%q) error: %v", tt.number, err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Validate(%q) error = %v, want %v", tt.number, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewValidatorRejectsBadRules(t *testing.T) {
+	configRun := testValidatorConfig(t)
+	configRun.OrderChecksum = "crc32"
+	if _, err := NewValidator(configRun); err == nil {
+		t.Error("unknown checksum was accepted")
+	}
+	configRun = testValidatorConfig(t)
+	configRun.OrderMinLength, configRun.OrderMaxLength = 10, 5
+	if _, err := NewValidator(configRun); err == nil {
+		t.Error("min_length above max_length was accepted")
+	}
+	configRun = testValidatorConfig(t)
+	configRun.OrderMerchantRules = "missing.json"
+	if _, err := NewValidator(configRun); err == nil {
+		t.Error("missing merchant rules file was accepted")
+	}
+}
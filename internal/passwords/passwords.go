@@ -0,0 +1,131 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+
+	argon2Prefix  = "$argon2id$"
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+type Hasher struct {
+	Algorithm     string
+	Cost          int
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+func NewHasher(configRun *config.Config) *Hasher {
+	return &Hasher{
+		Algorithm:     configRun.PasswordAlgorithm,
+		Cost:          configRun.PasswordCost,
+		Argon2Time:    configRun.PasswordArgon2Time,
+		Argon2Memory:  configRun.PasswordArgon2Memory,
+		Argon2Threads: configRun.PasswordArgon2Threads,
+	}
+}
+
+// IsLegacy reports whether the stored value is a plaintext password written before hashing was introduced
+func IsLegacy(encoded string) bool {
+	return !isBcrypt(encoded) && !strings.HasPrefix(encoded, argon2Prefix)
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *Hasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case AlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+		return string(hash), err
+	case AlgorithmArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, h.Argon2Time, h.Argon2Memory, h.Argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, h.Argon2Memory, h.Argon2Time, h.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	return "", errors.Errorf("unknown password algorithm %q", h.Algorithm)
+}
+
+// Verify compares password with the stored value in constant time, legacy plaintext values included
+func (h *Hasher) Verify(encoded string, password string) (bool, error) {
+	switch {
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(encoded, argon2Prefix):
+		params, salt, key, err := decodeArgon2(encoded)
+		if err != nil {
+			return false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(candidate, key) == 1, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(encoded), []byte(password)) == 1, nil
+}
+
+// NeedsRehash reports whether the stored value was produced with another algorithm or weaker settings
+func (h *Hasher) NeedsRehash(encoded string) bool {
+	switch {
+	case isBcrypt(encoded):
+		if h.Algorithm != AlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost != h.Cost
+	case strings.HasPrefix(encoded, argon2Prefix):
+		if h.Algorithm != AlgorithmArgon2id {
+			return true
+		}
+		params, _, _, err := decodeArgon2(encoded)
+		return err != nil || params.Argon2Time != h.Argon2Time || params.Argon2Memory != h.Argon2Memory || params.Argon2Threads != h.Argon2Threads
+	}
+	return true
+}
+
+func decodeArgon2(encoded string) (params Hasher, salt []byte, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		err = errors.New("bad argon2id hash format")
+		return
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
+	}
+	if version != argon2.Version {
+		err = errors.Errorf("unsupported argon2 version %d", version)
+		return
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads); err != nil {
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	return
+}
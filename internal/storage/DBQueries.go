@@ -1,82 +1,154 @@
 package storage
 
 type PostgresDB struct {
-	queryInitUsers               string
-	querySelectMaxIDUsers        string
-	querySelectCountUsers        string
 	querySelectIDByLogin         string
 	querySelectCountByLogin      string
 	queryInsertUser              string
-	queryInitOrders              string
-	queryInitWithdraws           string
-	queryInitBalance             string
 	querySelectCountOrdersByID   string
 	querySelectOrderByUserID     string
+	querySelectCountOrdersByUser string
 	querySelectWithdrawsByUserID string
+	querySelectCountWithdrawsBy  string
 	querySelectOrderInfoByID     string
 	querySelectCountByOrder      string
 	queryInsertOrder             string
+	queryInsertOrderIfAbsent     string
+	querySelectOrderOwner        string
 	querySelectBalance           string
 	queryInsertWithdraw          string
+	querySelectWithdrawExists    string
+	queryLockBalance             string
 	queryUpdateIncreaseBalance   string
 	queryUpdateDecreaseBalance   string
 	queryInsertUserBalance       string
 	queryCheckPassword           string
-	querySelectOrdersToProcess   string
+	queryClaimOrders             string
+	queryRetryOrder              string
+	queryReleaseOrder            string
+	querySelectOrderForUpdate    string
 	queryUpdateOrdersAccrual     string
+	queryInitMigrations          string
+	queryMigrationsLock          string
+	queryMigrationsUnlock        string
+	querySelectMigrations        string
+	queryInsertMigration         string
+	queryDeleteMigration         string
+	queryInsertLedgerEntry       string
+	querySelectReconcile         string
+	queryUpdatePassword          string
+	querySelectPasswords         string
+	queryInsertSession           string
+	querySelectSessionForUpdate  string
+	queryRevokeSession           string
+	queryRevokeUserSessions      string
+	queryInsertRevokedToken      string
+	queryDeleteRevokedTokens     string
+	querySelectTokenRevoked      string
+	queryInsertOrderHistory      string
+	querySelectOrderHistory      string
 }
 
 var PostgresDBRun = PostgresDB{
-	queryInitUsers: `CREATE TABLE IF NOT EXISTS users (
-				  id_user           INT UNIQUE PRIMARY KEY,
-				  login 	  TEXT UNIQUE NOT NULL,
-				  password		   TEXT NOT NULL);`,
-	queryInitBalance: `CREATE TABLE IF NOT EXISTS balance (
-				  id_user           INT UNIQUE PRIMARY KEY,
-				  	  accruals	double precision,
-				  	  withdrawn	double precision,
-				  	  current	double precision);`,
-	querySelectMaxIDUsers:   `SELECT MAX(id_user) FROM users;`,
-	querySelectCountUsers:   `SELECT count(id_user) FROM users;`,
 	querySelectIDByLogin:    `SELECT id_user FROM users WHERE login = $1;`,
 	querySelectCountByLogin: `SELECT count(id_user) FROM users WHERE login = $1;`,
 	queryInsertUser: `INSERT INTO users(
-					id_user, login, password
+					login, password
 					)
-					VALUES($1, $2, $3);`,
+					VALUES($1, $2) RETURNING id_user;`,
 	queryInsertUserBalance: `INSERT INTO balance(
 					id_user, current, accruals, withdrawn
 					)
 					VALUES($1, 0, 0, 0);`,
-	queryInitOrders: `CREATE TABLE IF NOT EXISTS orders (
-				  id_order           bigint UNIQUE PRIMARY KEY NOT NULL,
-				  id_user           INT NOT NULL,
-				  state 	  TEXT,
-				  accrual	double precision ,
-					uploaded_at TIMESTAMP );`,
-	queryInitWithdraws: `CREATE TABLE IF NOT EXISTS withdraws (
-				  id_order           bigint UNIQUE PRIMARY KEY NOT NULL,
-				  id_user           INT NOT NULL,
-					withdraw double precision,
-					processed_at TIMESTAMP );`,
 	querySelectOrderInfoByID:     `SELECT id_order, id_user, state, accrual, uploaded_at FROM orders WHERE id_order = $1 ORDER BY uploaded_at ASC;`,
 	querySelectCountOrdersByID:   `SELECT COUNT(id_order) FROM orders WHERE id_order = $1;`,
-	querySelectOrderByUserID:     `SELECT id_order, state, accrual, uploaded_at FROM orders WHERE id_user = $1;`,
-	querySelectWithdrawsByUserID: `SELECT id_order, withdraw, processed_at FROM withdraws WHERE id_user = $1 ORDER BY processed_at ASC;`,
+	querySelectOrderByUserID:     `SELECT id_order, state, accrual, uploaded_at FROM orders WHERE id_user = $1`,
+	querySelectCountOrdersByUser: `SELECT COUNT(*) FROM orders WHERE id_user = $1`,
+	querySelectWithdrawsByUserID: `SELECT id_order, withdraw, processed_at FROM withdraws WHERE id_user = $1`,
+	querySelectCountWithdrawsBy:  `SELECT COUNT(*) FROM withdraws WHERE id_user = $1`,
 	queryInsertOrder: `INSERT INTO orders(
 					id_order, id_user, state, accrual, uploaded_at
 					)
 					VALUES($1, $2, $3, $4, $5);`,
+	queryInsertOrderIfAbsent: `INSERT INTO orders(
+					id_order, id_user, state, accrual, uploaded_at
+					)
+					VALUES($1, $2, $3, 0, $4)
+					ON CONFLICT (id_order) DO NOTHING;`,
+	querySelectOrderOwner: `SELECT id_user FROM orders WHERE id_order = $1;`,
 	queryInsertWithdraw: `INSERT INTO withdraws(
 					id_order, id_user, withdraw, processed_at
 					)
 					VALUES($1, $2, $3, $4);`,
-	querySelectBalance: `SELECT current, accruals, withdrawn FROM balance WHERE id_user = $1;`,
+	querySelectWithdrawExists: `SELECT EXISTS(SELECT 1 FROM withdraws WHERE id_order = $1);`,
+	queryLockBalance:          `SELECT 1 FROM balance WHERE id_user = $1 FOR UPDATE;`,
+	querySelectBalance:        `SELECT current, accruals, withdrawn FROM balance WHERE id_user = $1;`,
 	queryUpdateIncreaseBalance: `UPDATE balance set current = current + $2, accruals = accruals + $2 
 					where id_user = $1;`,
 	queryUpdateDecreaseBalance: `UPDATE balance set current = current - $2, withdrawn = withdrawn + $2 
-					where id_user = $1;`,
-	queryCheckPassword:         `SELECT password FROM users WHERE login = $1;`,
-	querySelectOrdersToProcess: `SELECT id_order FROM orders WHERE state in ('NEW', 'REGISTERED', 'PROCESSING');`,
-	queryUpdateOrdersAccrual:   `UPDATE orders SET state = $2 WHERE id_order = $1;`,
+					where id_user = $1 AND current >= $2;`,
+	queryCheckPassword: `SELECT password FROM users WHERE login = $1;`,
+	queryClaimOrders: `UPDATE orders SET locked_by = $1, locked_until = now() + $3::BIGINT * interval '1 millisecond'
+					WHERE id_order IN (
+						SELECT id_order FROM orders
+						WHERE state IN ('NEW', 'REGISTERED', 'PROCESSING') AND next_attempt_at <= now()
+							AND (locked_until IS NULL OR locked_until < now())
+						ORDER BY next_attempt_at ASC
+						LIMIT $2
+						FOR UPDATE SKIP LOCKED
+					)
+					RETURNING id_order, attempts;`,
+	queryRetryOrder: `UPDATE orders SET attempts = attempts + 1, next_attempt_at = now() + $3::BIGINT * interval '1 millisecond',
+					locked_by = NULL, locked_until = NULL
+					WHERE id_order = $1 AND locked_by = $2;`,
+	queryReleaseOrder: `UPDATE orders SET next_attempt_at = now() + $3::BIGINT * interval '1 millisecond',
+					locked_by = NULL, locked_until = NULL
+					WHERE id_order = $1 AND locked_by = $2;`,
+	querySelectOrderForUpdate: `SELECT id_user, state FROM orders WHERE id_order = $1 FOR UPDATE;`,
+	queryUpdateOrdersAccrual: `UPDATE orders SET state = $2, accrual = $3, attempts = 0, next_attempt_at = now(),
+					locked_by = NULL, locked_until = NULL
+					WHERE id_order = $1 AND state = $4;`,
+	queryInitMigrations: `CREATE TABLE IF NOT EXISTS schema_migrations (
+				  version           INT UNIQUE PRIMARY KEY,
+				  name 	  TEXT NOT NULL,
+				  applied_at		   TIMESTAMP NOT NULL);`,
+	queryMigrationsLock:   `SELECT pg_advisory_lock($1);`,
+	queryMigrationsUnlock: `SELECT pg_advisory_unlock($1);`,
+	querySelectMigrations: `SELECT version, applied_at FROM schema_migrations ORDER BY version ASC;`,
+	queryInsertMigration:  `INSERT INTO schema_migrations(version, name, applied_at) VALUES($1, $2, $3);`,
+	queryDeleteMigration:  `DELETE FROM schema_migrations WHERE version = $1;`,
+	queryInsertLedgerEntry: `INSERT INTO ledger(
+					id_user, account, id_order, kind, amount, created_at, idempotency_key
+					)
+					VALUES($1, $2, $4, $5, $6, $7, $8), ($1, $3, $4, $5, -($6::BIGINT), $7, $8)
+					ON CONFLICT (idempotency_key, account) DO NOTHING;`,
+	querySelectReconcile: `SELECT b.id_user, b.current, b.accruals, b.withdrawn,
+					COALESCE(SUM(l.amount), 0),
+					COALESCE(SUM(l.amount) FILTER (WHERE l.kind IN ($2, $3)), 0),
+					COALESCE(-SUM(l.amount) FILTER (WHERE l.kind = $4), 0)
+					FROM balance b LEFT JOIN ledger l ON l.id_user = b.id_user AND l.account = $1
+					GROUP BY b.id_user, b.current, b.accruals, b.withdrawn
+					HAVING b.current <> COALESCE(SUM(l.amount), 0)
+						OR b.accruals <> COALESCE(SUM(l.amount) FILTER (WHERE l.kind IN ($2, $3)), 0)
+						OR b.withdrawn <> COALESCE(-SUM(l.amount) FILTER (WHERE l.kind = $4), 0)
+					ORDER BY b.id_user;`,
+	queryUpdatePassword:  `UPDATE users SET password = $2 WHERE login = $1;`,
+	querySelectPasswords: `SELECT password FROM users;`,
+	queryInsertSession: `INSERT INTO sessions(
+					id_session, id_user, created_at, expires_at
+					)
+					VALUES($1, $2, $3, $4);`,
+	querySelectSessionForUpdate: `SELECT s.id_user, u.login, s.created_at, s.expires_at, s.revoked_at IS NOT NULL
+					FROM sessions s JOIN users u ON u.id_user = s.id_user
+					WHERE s.id_session = $1 FOR UPDATE OF s;`,
+	queryRevokeSession:       `UPDATE sessions SET revoked_at = $2 WHERE id_session = $1 AND revoked_at IS NULL;`,
+	queryRevokeUserSessions:  `UPDATE sessions SET revoked_at = $2 WHERE id_user = $1 AND revoked_at IS NULL;`,
+	queryInsertRevokedToken:  `INSERT INTO revoked_tokens(jti, expires_at) VALUES($1, $2) ON CONFLICT (jti) DO NOTHING;`,
+	queryDeleteRevokedTokens: `DELETE FROM revoked_tokens WHERE expires_at < $1;`,
+	querySelectTokenRevoked:  `SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1);`,
+	queryInsertOrderHistory: `INSERT INTO order_status_history(
+					id_order, old_state, new_state, accrual, changed_at
+					)
+					VALUES($1, $2, $3, $4, $5);`,
+	querySelectOrderHistory: `SELECT old_state, new_state, accrual, changed_at FROM order_status_history
+					WHERE id_order = $1 ORDER BY id_entry ASC;`,
 }
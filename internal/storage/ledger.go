@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/valentinaskakun/gophermart/internal/money"
+)
+
+const (
+	LedgerKindAccrual    = "accrual"
+	LedgerKindWithdrawal = "withdrawal"
+	LedgerKindAdjustment = "adjustment"
+	LedgerKindReversal   = "reversal"
+
+	// ledgerAccountUser is the leg that belongs to the user, its sum is the user's current balance
+	ledgerAccountUser = "user"
+)
+
+// LedgerEntry is one balance movement, Amount is signed from the user's point of view
+type LedgerEntry struct {
+	IDUser         int
+	IDOrder        string
+	Kind           string
+	Amount         money.Amount
+	CreatedAt      time.Time
+	IdempotencyKey string
+}
+
+// ReconcileMismatch describes a user whose balance row disagrees with the ledger
+type ReconcileMismatch struct {
+	IDUser          int
+	Current         money.Amount
+	Accruals        money.Amount
+	Withdrawn       money.Amount
+	LedgerCurrent   money.Amount
+	LedgerAccruals  money.Amount
+	LedgerWithdrawn money.Amount
+}
+
+// counterAccount is the system account that takes the opposite leg of a movement
+func counterAccount(kind string) string {
+	switch kind {
+	case LedgerKindAccrual, LedgerKindReversal:
+		return "accruals"
+	case LedgerKindWithdrawal:
+		return "withdrawals"
+	}
+	return "adjustments"
+}
+
+func accrualLedgerEntry(userID int, orderID string, amount money.Amount) LedgerEntry {
+	return LedgerEntry{
+		IDUser:         userID,
+		IDOrder:        orderID,
+		Kind:           LedgerKindAccrual,
+		Amount:         amount,
+		CreatedAt:      time.Now(),
+		IdempotencyKey: "accrual:" + orderID,
+	}
+}
+
+func withdrawalLedgerEntry(userID int, orderID string, amount money.Amount) LedgerEntry {
+	return LedgerEntry{
+		IDUser:         userID,
+		IDOrder:        orderID,
+		Kind:           LedgerKindWithdrawal,
+		Amount:         -amount,
+		CreatedAt:      time.Now(),
+		IdempotencyKey: "withdrawal:" + orderID,
+	}
+}
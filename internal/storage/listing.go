@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListFilter narrows and pages the order and withdrawal lists, zero values mean no restriction.
+// States only applies to orders, From is inclusive and To is exclusive
+type ListFilter struct {
+	States     []string
+	From       time.Time
+	To         time.Time
+	Descending bool
+	Limit      int
+	Cursor     *ListCursor
+}
+
+// ListCursor points at the last row of a page, rows are ordered by time and then by order number
+type ListCursor struct {
+	At      time.Time
+	IDOrder string
+}
+
+// ListPage describes the page around the returned rows: Total counts every row matching the filter
+// regardless of the cursor, Next is nil on the last page
+type ListPage struct {
+	Total int
+	Next  *ListCursor
+}
+
+func (c ListCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.At.UnixNano(), 10) + ":" + c.IDOrder))
+}
+
+func DecodeListCursor(encoded string) (*ListCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &ListCursor{At: time.Unix(0, nanos).UTC(), IDOrder: parts[1]}, nil
+}
+
+// after reports whether a row at (at, idOrder) comes after the cursor in the filter's sort order
+func (filter *ListFilter) after(at time.Time, idOrder string) bool {
+	if filter.Cursor == nil {
+		return true
+	}
+	c := filter.Cursor
+	if filter.Descending {
+		return at.Before(c.At) || (at.Equal(c.At) && idOrder < c.IDOrder)
+	}
+	return at.After(c.At) || (at.Equal(c.At) && idOrder > c.IDOrder)
+}
+
+// matches applies every filter except the cursor
+func (filter *ListFilter) matches(state string, at time.Time) bool {
+	if len(filter.States) > 0 {
+		found := false
+		for _, s := range filter.States {
+			if s == state {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !filter.From.IsZero() && at.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !at.Before(filter.To) {
+		return false
+	}
+	return true
+}
+
+// listQuery appends the filter conditions to a query selecting one user's rows, timeColumn and
+// idColumn give the sort order. It returns the page query and the count query sharing the filters
+func listQuery(selectQuery, countQuery, timeColumn, idColumn string, filter *ListFilter, userID int) (query string, args []interface{}, count string, countArgs []interface{}) {
+	args = []interface{}{userID}
+	var where strings.Builder
+	placeholder := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if len(filter.States) > 0 {
+		placeholders := make([]string, len(filter.States))
+		for i, state := range filter.States {
+			placeholders[i] = placeholder(state)
+		}
+		where.WriteString(" AND state IN (" + strings.Join(placeholders, ", ") + ")")
+	}
+	if !filter.From.IsZero() {
+		where.WriteString(" AND " + timeColumn + " >= " + placeholder(filter.From))
+	}
+	if !filter.To.IsZero() {
+		where.WriteString(" AND " + timeColumn + " < " + placeholder(filter.To))
+	}
+	count = countQuery + where.String() + ";"
+	countArgs = append([]interface{}{}, args...)
+	direction, compare := "ASC", ">"
+	if filter.Descending {
+		direction, compare = "DESC", "<"
+	}
+	if filter.Cursor != nil {
+		where.WriteString(" AND (" + timeColumn + ", " + idColumn + ") " + compare +
+			" (" + placeholder(filter.Cursor.At) + ", " + placeholder(filter.Cursor.IDOrder) + ")")
+	}
+	query = selectQuery + where.String() + " ORDER BY " + timeColumn + " " + direction + ", " + idColumn + " " + direction
+	if filter.Limit > 0 {
+		// one extra row tells whether there is a next page
+		query += " LIMIT " + placeholder(filter.Limit+1)
+	}
+	return query + ";", args, count, countArgs
+}
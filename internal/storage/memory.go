@@ -0,0 +1,542 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valentinaskakun/gophermart/internal/logging"
+	"github.com/valentinaskakun/gophermart/internal/passwords"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type memoryQueueEntry struct {
+	attempts      int
+	nextAttemptAt time.Time
+	lockedBy      string
+	lockedUntil   time.Time
+}
+
+type memoryWithdraw struct {
+	IDUser int
+	UsingWithdrawStruct
+}
+
+// MemoryStorage keeps everything in process memory, every method runs under a single mutex
+// so multi-step operations such as NewWithdraw behave like a committed transaction
+type MemoryStorage struct {
+	mu         sync.Mutex
+	lastUserID int
+	users      map[string]CredUserStruct
+	userIDs    map[string]int
+	balances   map[int]UsingUserBalanceStruct
+	orders     map[string]UsingOrderStruct
+	queue      map[string]memoryQueueEntry
+	withdraws  map[string]memoryWithdraw
+	history    map[string][]OrderStatusChangeStruct
+	ledger     []LedgerEntry
+	ledgerKeys map[string]bool
+	sessions   map[string]SessionStruct
+	revoked    map[string]time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		users:      make(map[string]CredUserStruct),
+		userIDs:    make(map[string]int),
+		balances:   make(map[int]UsingUserBalanceStruct),
+		orders:     make(map[string]UsingOrderStruct),
+		queue:      make(map[string]memoryQueueEntry),
+		withdraws:  make(map[string]memoryWithdraw),
+		history:    make(map[string][]OrderStatusChangeStruct),
+		ledgerKeys: make(map[string]bool),
+		sessions:   make(map[string]SessionStruct),
+		revoked:    make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryStorage) Migrate(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+func (s *MemoryStorage) InsertUser(ctx context.Context, userAuthInfo *CredUserStruct) (userID int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userAuthInfo.Login]; ok {
+		err = ErrLoginExists
+		return
+	}
+	s.lastUserID++
+	userID = s.lastUserID
+	s.users[userAuthInfo.Login] = *userAuthInfo
+	s.userIDs[userAuthInfo.Login] = userID
+	s.balances[userID] = UsingUserBalanceStruct{IDUser: userID}
+	return
+}
+
+func (s *MemoryStorage) ReturnPasswordByLogin(ctx context.Context, login *string) (password string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[*login]
+	if !ok {
+		err = ErrNotFound
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "MemoryStorage.ReturnPasswordByLogin " + *login,
+		}).Error(err)
+		return
+	}
+	password = user.Password
+	return
+}
+
+func (s *MemoryStorage) UpdateUserPassword(ctx context.Context, login *string, password string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[*login]
+	if !ok {
+		err = ErrNotFound
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "MemoryStorage.UpdateUserPassword " + *login,
+		}).Error(err)
+		return
+	}
+	user.Password = password
+	s.users[*login] = user
+	return
+}
+
+func (s *MemoryStorage) CountLegacyPasswords(ctx context.Context) (total int, legacy int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		total++
+		if passwords.IsLegacy(user.Password) {
+			legacy++
+		}
+	}
+	return
+}
+
+func (s *MemoryStorage) ReturnIDByLogin(ctx context.Context, login *string) (userAuthInfo UsingUserStruct, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userAuthInfo.Login = *login
+	userAuthInfo.IDUser = s.userIDs[*login]
+	return
+}
+
+func (s *MemoryStorage) InsertOrder(ctx context.Context, order *UsingOrderStruct) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.orders[order.Number]; ok {
+		err = errors.Errorf("order %s already exists", order.Number)
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "MemoryStorage.InsertOrder",
+		}).Error(err)
+		return
+	}
+	stored := *order
+	stored.Accrual = 0
+	s.orders[order.Number] = stored
+	s.queue[order.Number] = memoryQueueEntry{nextAttemptAt: time.Now()}
+	return
+}
+
+func (s *MemoryStorage) InsertOrders(ctx context.Context, arrOrders []UsingOrderStruct) (arrResults []InsertedOrderStruct, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arrResults = make([]InsertedOrderStruct, 0, len(arrOrders))
+	for _, order := range arrOrders {
+		if stored, ok := s.orders[order.Number]; ok {
+			arrResults = append(arrResults, InsertedOrderStruct{Number: order.Number, IDUser: stored.IDUser})
+			continue
+		}
+		stored := order
+		stored.Accrual = 0
+		s.orders[order.Number] = stored
+		s.queue[order.Number] = memoryQueueEntry{nextAttemptAt: time.Now()}
+		arrResults = append(arrResults, InsertedOrderStruct{Number: order.Number, IDUser: order.IDUser, Inserted: true})
+	}
+	return
+}
+
+func (s *MemoryStorage) NewWithdraw(ctx context.Context, order *OrderToWithdrawStruct, userID *int) (isBalance bool, result bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userBalanceInfo, ok := s.balances[*userID]
+	if !ok {
+		err = ErrNotFound
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "MemoryStorage.NewWithdraw balance",
+		}).Error(err)
+		return
+	}
+	// a repeated order is reported before the balance is checked, like in PostgresStorage
+	if _, ok := s.withdraws[order.IDOrder]; ok {
+		err = ErrWithdrawalExists
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "MemoryStorage.NewWithdraw",
+		}).Error(err)
+		return
+	}
+	if userBalanceInfo.Current < order.Sum {
+		isBalance = false
+		result = true
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "MemoryStorage.NewWithdraw balance < sum",
+		}).Info()
+		return
+	}
+	isBalance = true
+	if !s.appendLedgerEntry(withdrawalLedgerEntry(*userID, order.IDOrder, order.Sum)) {
+		err = ErrWithdrawalExists
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "MemoryStorage.NewWithdraw.appendLedgerEntry",
+		}).Error(err)
+		return
+	}
+	userBalanceInfo.Current -= order.Sum
+	userBalanceInfo.Withdrawn += order.Sum
+	s.balances[*userID] = userBalanceInfo
+	s.withdraws[order.IDOrder] = memoryWithdraw{
+		IDUser: *userID,
+		UsingWithdrawStruct: UsingWithdrawStruct{
+			IDOrder:     order.IDOrder,
+			Withdraw:    order.Sum,
+			ProcessedAt: time.Now(),
+		},
+	}
+	result = true
+	return
+}
+
+func (s *MemoryStorage) ReturnOrdersInfoByUserID(ctx context.Context, userID int, filter *ListFilter) (isOrders bool, arrOrders []UsingOrderStruct, page ListPage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, order := range s.orders {
+		if order.IDUser != userID || !filter.matches(order.State, order.UploadedAt) {
+			continue
+		}
+		page.Total++
+		if !filter.after(order.UploadedAt, order.Number) {
+			continue
+		}
+		arrOrders = append(arrOrders, UsingOrderStruct{
+			Number:     order.Number,
+			State:      order.State,
+			Accrual:    order.Accrual,
+			UploadedAt: order.UploadedAt,
+		})
+	}
+	sort.Slice(arrOrders, func(i, j int) bool {
+		a, b := arrOrders[i], arrOrders[j]
+		if filter.Descending {
+			a, b = b, a
+		}
+		return a.UploadedAt.Before(b.UploadedAt) || (a.UploadedAt.Equal(b.UploadedAt) && a.Number < b.Number)
+	})
+	if filter.Limit > 0 && len(arrOrders) > filter.Limit {
+		arrOrders = arrOrders[:filter.Limit]
+		last := arrOrders[len(arrOrders)-1]
+		page.Next = &ListCursor{At: last.UploadedAt, IDOrder: last.Number}
+	}
+	isOrders = len(arrOrders) > 0
+	return
+}
+
+func (s *MemoryStorage) ReturnBalanceByUserID(ctx context.Context, IDUser *int) (userBalanceInfo UsingUserBalanceStruct, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userBalanceInfo, ok := s.balances[*IDUser]
+	if !ok {
+		err = ErrNotFound
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "MemoryStorage.ReturnBalanceByUserID",
+		}).Error(err)
+		return
+	}
+	userBalanceInfo.IDUser = 0
+	return
+}
+
+func (s *MemoryStorage) ReturnOrderInfoByID(ctx context.Context, number string) (orderInfo UsingOrderStruct, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orderInfo.Number = number
+	if order, ok := s.orders[number]; ok {
+		orderInfo.IDUser = order.IDUser
+		orderInfo.State = order.State
+		orderInfo.Accrual = order.Accrual
+		orderInfo.UploadedAt = order.UploadedAt
+	}
+	return
+}
+
+func (s *MemoryStorage) ReturnWithdrawsInfoByUserID(ctx context.Context, userID *int, filter *ListFilter) (isWithdraws bool, arrWithdraws []UsingWithdrawStruct, page ListPage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, withdraw := range s.withdraws {
+		if withdraw.IDUser != *userID || !filter.matches("", withdraw.ProcessedAt) {
+			continue
+		}
+		page.Total++
+		if !filter.after(withdraw.ProcessedAt, withdraw.IDOrder) {
+			continue
+		}
+		arrWithdraws = append(arrWithdraws, withdraw.UsingWithdrawStruct)
+	}
+	sort.Slice(arrWithdraws, func(i, j int) bool {
+		a, b := arrWithdraws[i], arrWithdraws[j]
+		if filter.Descending {
+			a, b = b, a
+		}
+		return a.ProcessedAt.Before(b.ProcessedAt) || (a.ProcessedAt.Equal(b.ProcessedAt) && a.IDOrder < b.IDOrder)
+	})
+	if filter.Limit > 0 && len(arrWithdraws) > filter.Limit {
+		arrWithdraws = arrWithdraws[:filter.Limit]
+		last := arrWithdraws[len(arrWithdraws)-1]
+		page.Next = &ListCursor{At: last.ProcessedAt, IDOrder: last.IDOrder}
+	}
+	isWithdraws = len(arrWithdraws) > 0
+	return
+}
+
+func (s *MemoryStorage) ClaimOrders(ctx context.Context, workerID string, limit int, lease time.Duration) (arrOrders []QueuedOrderStruct, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var due []string
+	for id, order := range s.orders {
+		switch order.State {
+		case OrderStateNew, OrderStateRegistered, OrderStateProcessing:
+		default:
+			continue
+		}
+		entry := s.queue[id]
+		if entry.nextAttemptAt.After(now) || entry.lockedUntil.After(now) {
+			continue
+		}
+		due = append(due, id)
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return s.queue[due[i]].nextAttemptAt.Before(s.queue[due[j]].nextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, id := range due {
+		entry := s.queue[id]
+		entry.lockedBy = workerID
+		entry.lockedUntil = now.Add(lease)
+		s.queue[id] = entry
+		arrOrders = append(arrOrders, QueuedOrderStruct{IDOrder: id, Attempts: entry.attempts})
+	}
+	return
+}
+
+func (s *MemoryStorage) RetryOrder(ctx context.Context, orderID string, workerID string, delay time.Duration) error {
+	return s.unlockOrder(orderID, workerID, delay, true)
+}
+
+func (s *MemoryStorage) ReleaseOrder(ctx context.Context, orderID string, workerID string, delay time.Duration) error {
+	return s.unlockOrder(orderID, workerID, delay, false)
+}
+
+func (s *MemoryStorage) unlockOrder(orderID string, workerID string, delay time.Duration, failed bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.queue[orderID]
+	if !ok || entry.lockedBy != workerID {
+		return nil
+	}
+	if failed {
+		entry.attempts++
+	}
+	entry.nextAttemptAt = time.Now().Add(delay)
+	entry.lockedBy = ""
+	entry.lockedUntil = time.Time{}
+	s.queue[orderID] = entry
+	return nil
+}
+
+func (s *MemoryStorage) ReturnOrderHistory(ctx context.Context, number string) (arrHistory []OrderStatusChangeStruct, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arrHistory = append(arrHistory, s.history[number]...)
+	return
+}
+
+func (s *MemoryStorage) UpdateOrderAccrual(ctx context.Context, orderAccrual *UsingAccrualStruct) (err error) {
+	if err = checkAccrual(ctx, orderAccrual); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order, ok := s.orders[orderAccrual.Order]
+	if !ok {
+		err = ErrNotFound
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "MemoryStorage.UpdateOrderAccrual " + orderAccrual.Order,
+		}).Error(err)
+		return
+	}
+	if order.State == orderAccrual.Status && IsFinalState(order.State) {
+		return nil
+	}
+	if !CanTransition(order.State, orderAccrual.Status) {
+		return illegalTransition(ctx, orderAccrual.Order, order.State, orderAccrual.Status)
+	}
+	oldState := order.State
+	order.State = orderAccrual.Status
+	order.Accrual = 0
+	if orderAccrual.Status == OrderStateProcessed {
+		order.Accrual = orderAccrual.Accrual
+	}
+	if oldState != order.State {
+		s.history[orderAccrual.Order] = append(s.history[orderAccrual.Order], OrderStatusChangeStruct{
+			OldState:  oldState,
+			NewState:  order.State,
+			Accrual:   order.Accrual,
+			ChangedAt: time.Now(),
+		})
+	}
+	s.orders[orderAccrual.Order] = order
+	s.queue[orderAccrual.Order] = memoryQueueEntry{nextAttemptAt: time.Now()}
+	if order.Accrual != 0 && s.appendLedgerEntry(accrualLedgerEntry(order.IDUser, orderAccrual.Order, order.Accrual)) {
+		userBalanceInfo := s.balances[order.IDUser]
+		userBalanceInfo.Current += order.Accrual
+		userBalanceInfo.Accrual += order.Accrual
+		s.balances[order.IDUser] = userBalanceInfo
+	}
+	return
+}
+
+// appendLedgerEntry must be called with s.mu held, it returns false for an already used idempotency key
+func (s *MemoryStorage) appendLedgerEntry(entry LedgerEntry) bool {
+	if s.ledgerKeys[entry.IdempotencyKey] {
+		return false
+	}
+	s.ledgerKeys[entry.IdempotencyKey] = true
+	s.ledger = append(s.ledger, entry)
+	return true
+}
+
+func (s *MemoryStorage) Reconcile(ctx context.Context) (mismatches []ReconcileMismatch, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fromLedger := make(map[int]*ReconcileMismatch)
+	for userID, balance := range s.balances {
+		fromLedger[userID] = &ReconcileMismatch{
+			IDUser:    userID,
+			Current:   balance.Current,
+			Accruals:  balance.Accrual,
+			Withdrawn: balance.Withdrawn,
+		}
+	}
+	for _, entry := range s.ledger {
+		mismatch, ok := fromLedger[entry.IDUser]
+		if !ok {
+			continue
+		}
+		mismatch.LedgerCurrent += entry.Amount
+		switch entry.Kind {
+		case LedgerKindAccrual, LedgerKindReversal:
+			mismatch.LedgerAccruals += entry.Amount
+		case LedgerKindWithdrawal:
+			mismatch.LedgerWithdrawn -= entry.Amount
+		}
+	}
+	for _, mismatch := range fromLedger {
+		if mismatch.Current != mismatch.LedgerCurrent || mismatch.Accruals != mismatch.LedgerAccruals || mismatch.Withdrawn != mismatch.LedgerWithdrawn {
+			mismatches = append(mismatches, *mismatch)
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].IDUser < mismatches[j].IDUser
+	})
+	return
+}
+
+func (s *MemoryStorage) InsertSession(ctx context.Context, session *SessionStruct) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *session
+	stored.Revoked = false
+	s.sessions[session.IDSession] = stored
+	return nil
+}
+
+func (s *MemoryStorage) RotateSession(ctx context.Context, oldSessionID string, session *SessionStruct) (oldSession SessionStruct, rotated bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldSession, ok := s.sessions[oldSessionID]
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	for login, userID := range s.userIDs {
+		if userID == oldSession.IDUser {
+			oldSession.Login = login
+		}
+	}
+	if oldSession.Revoked || !oldSession.ExpiresAt.After(time.Now()) {
+		return
+	}
+	revokedSession := oldSession
+	revokedSession.Revoked = true
+	s.sessions[oldSessionID] = revokedSession
+	session.IDUser = oldSession.IDUser
+	session.Login = oldSession.Login
+	s.sessions[session.IDSession] = *session
+	rotated = true
+	return
+}
+
+func (s *MemoryStorage) RevokeSession(ctx context.Context, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[sessionID]; ok {
+		session.Revoked = true
+		s.sessions[sessionID] = session
+	}
+	return nil
+}
+
+func (s *MemoryStorage) RevokeUserSessions(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.IDUser == userID {
+			session.Revoked = true
+			s.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, until := range s.revoked {
+		if until.Before(now) {
+			delete(s.revoked, id)
+		}
+	}
+	s.revoked[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryStorage) IsTokenRevoked(ctx context.Context, jti string) (revoked bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, revoked = s.revoked[jti]
+	return
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the pg_advisory_lock key shared by every gophermart replica
+const migrationLockID = 7264917
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	timeout    time.Duration
+}
+
+// loadMigrations reads migrations/NNNN_name.up.sql and NNNN_name.down.sql pairs ordered by version
+func loadMigrations() (migrations []Migration, err error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("bad migration file name %s", fileName)
+		}
+		version, errConv := strconv.Atoi(parts[0])
+		if errConv != nil {
+			return nil, errors.Wrapf(errConv, "bad migration version in %s", fileName)
+		}
+		body, errRead := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if errRead != nil {
+			return nil, errRead
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = migration
+		}
+		if direction == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+		}
+	}
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, errors.Errorf("migration %d has no up script", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return
+}
+
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "NewMigrator.loadMigrations()",
+		}).Error(err)
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, timeout: time.Minute}, nil
+}
+
+// withLock runs fn on a dedicated connection holding the migration advisory lock,
+// so replicas starting at the same time apply migrations one after another
+func (m *Migrator) withLock(ctx context.Context, fn func(ctx context.Context, conn *sql.Conn) error) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "Migrator.withLock.db.Conn()",
+		}).Error(err)
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, PostgresDBRun.queryMigrationsLock, migrationLockID); err != nil {
+		log.WithFields(log.Fields{
+			"func": "Migrator.withLock.PostgresDBRun.queryMigrationsLock",
+		}).Error(err)
+		return
+	}
+	defer conn.ExecContext(context.Background(), PostgresDBRun.queryMigrationsUnlock, migrationLockID)
+	if _, err = conn.ExecContext(ctx, PostgresDBRun.queryInitMigrations); err != nil {
+		log.WithFields(log.Fields{
+			"func": "Migrator.withLock.PostgresDBRun.queryInitMigrations",
+		}).Error(err)
+		return
+	}
+	return fn(ctx, conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (appliedAt map[int]time.Time, err error) {
+	appliedAt = make(map[int]time.Time)
+	rows, err := conn.QueryContext(ctx, PostgresDBRun.querySelectMigrations)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "Migrator.applied.PostgresDBRun.querySelectMigrations",
+		}).Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err = rows.Scan(&version, &at); err != nil {
+			return
+		}
+		appliedAt[version] = at
+	}
+	err = rows.Err()
+	return
+}
+
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, migration Migration, up bool) (err error) {
+	txn, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+	script, record, args := migration.Up, PostgresDBRun.queryInsertMigration, []interface{}{migration.Version, migration.Name, time.Now()}
+	if !up {
+		script, record, args = migration.Down, PostgresDBRun.queryDeleteMigration, []interface{}{migration.Version}
+	}
+	if _, err = txn.ExecContext(ctx, script); err != nil {
+		return errors.Wrapf(err, "migration %04d_%s", migration.Version, migration.Name)
+	}
+	if _, err = txn.ExecContext(ctx, record, args...); err != nil {
+		return
+	}
+	return txn.Commit()
+}
+
+// Up applies up to steps pending migrations, all of them when steps is 0
+func (m *Migrator) Up(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(ctx context.Context, conn *sql.Conn) error {
+		appliedAt, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		done := 0
+		for _, migration := range m.migrations {
+			if _, ok := appliedAt[migration.Version]; ok {
+				continue
+			}
+			if steps > 0 && done == steps {
+				break
+			}
+			if err = m.run(ctx, conn, migration, true); err != nil {
+				log.WithFields(log.Fields{
+					"func": "Migrator.Up",
+				}).Error(err)
+				return err
+			}
+			log.WithFields(log.Fields{
+				"func": fmt.Sprintf("Migrator.Up applied %04d_%s", migration.Version, migration.Name),
+			}).Info()
+			done++
+		}
+		return nil
+	})
+}
+
+// Down rolls back the last steps applied migrations, all of them when steps is 0
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(ctx context.Context, conn *sql.Conn) error {
+		appliedAt, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		done := 0
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := appliedAt[migration.Version]; !ok {
+				continue
+			}
+			if steps > 0 && done == steps {
+				break
+			}
+			if migration.Down == "" {
+				return errors.Errorf("migration %04d_%s can't be rolled back", migration.Version, migration.Name)
+			}
+			if err = m.run(ctx, conn, migration, false); err != nil {
+				log.WithFields(log.Fields{
+					"func": "Migrator.Down",
+				}).Error(err)
+				return err
+			}
+			log.WithFields(log.Fields{
+				"func": fmt.Sprintf("Migrator.Down rolled back %04d_%s", migration.Version, migration.Name),
+			}).Info()
+			done++
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) Status(ctx context.Context) (status []MigrationStatus, err error) {
+	err = m.withLock(ctx, func(ctx context.Context, conn *sql.Conn) error {
+		appliedAt, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			at, ok := appliedAt[migration.Version]
+			status = append(status, MigrationStatus{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Applied:   ok,
+				AppliedAt: at,
+			})
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS users (
+    id_user  INT UNIQUE PRIMARY KEY,
+    login    TEXT UNIQUE NOT NULL,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+    id_order    bigint UNIQUE PRIMARY KEY NOT NULL,
+    id_user     INT NOT NULL,
+    state       TEXT,
+    accrual     double precision,
+    uploaded_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS balance (
+    id_user   INT UNIQUE PRIMARY KEY,
+    accruals  double precision,
+    withdrawn double precision,
+    current   double precision
+);
+
+CREATE TABLE IF NOT EXISTS withdraws (
+    id_order     bigint UNIQUE PRIMARY KEY NOT NULL,
+    id_user      INT NOT NULL,
+    withdraw     double precision,
+    processed_at TIMESTAMP
+);
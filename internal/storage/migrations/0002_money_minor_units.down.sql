@@ -0,0 +1,23 @@
+ALTER TABLE withdraws
+    ALTER COLUMN withdraw DROP NOT NULL,
+    ALTER COLUMN withdraw DROP DEFAULT;
+ALTER TABLE withdraws
+    ALTER COLUMN withdraw TYPE double precision USING withdraw / 100.0;
+
+ALTER TABLE orders
+    ALTER COLUMN accrual DROP NOT NULL,
+    ALTER COLUMN accrual DROP DEFAULT;
+ALTER TABLE orders
+    ALTER COLUMN accrual TYPE double precision USING accrual / 100.0;
+
+ALTER TABLE balance
+    ALTER COLUMN accruals DROP NOT NULL,
+    ALTER COLUMN accruals DROP DEFAULT,
+    ALTER COLUMN withdrawn DROP NOT NULL,
+    ALTER COLUMN withdrawn DROP DEFAULT,
+    ALTER COLUMN current DROP NOT NULL,
+    ALTER COLUMN current DROP DEFAULT;
+ALTER TABLE balance
+    ALTER COLUMN accruals TYPE double precision USING accruals / 100.0,
+    ALTER COLUMN withdrawn TYPE double precision USING withdrawn / 100.0,
+    ALTER COLUMN current TYPE double precision USING current / 100.0;
@@ -0,0 +1,24 @@
+-- amounts are stored as integer hundredths of a point
+ALTER TABLE balance
+    ALTER COLUMN accruals TYPE BIGINT USING round(COALESCE(accruals, 0) * 100)::BIGINT,
+    ALTER COLUMN withdrawn TYPE BIGINT USING round(COALESCE(withdrawn, 0) * 100)::BIGINT,
+    ALTER COLUMN current TYPE BIGINT USING round(COALESCE(current, 0) * 100)::BIGINT;
+ALTER TABLE balance
+    ALTER COLUMN accruals SET DEFAULT 0,
+    ALTER COLUMN accruals SET NOT NULL,
+    ALTER COLUMN withdrawn SET DEFAULT 0,
+    ALTER COLUMN withdrawn SET NOT NULL,
+    ALTER COLUMN current SET DEFAULT 0,
+    ALTER COLUMN current SET NOT NULL;
+
+ALTER TABLE orders
+    ALTER COLUMN accrual TYPE BIGINT USING round(COALESCE(accrual, 0) * 100)::BIGINT;
+ALTER TABLE orders
+    ALTER COLUMN accrual SET DEFAULT 0,
+    ALTER COLUMN accrual SET NOT NULL;
+
+ALTER TABLE withdraws
+    ALTER COLUMN withdraw TYPE BIGINT USING round(COALESCE(withdraw, 0) * 100)::BIGINT;
+ALTER TABLE withdraws
+    ALTER COLUMN withdraw SET DEFAULT 0,
+    ALTER COLUMN withdraw SET NOT NULL;
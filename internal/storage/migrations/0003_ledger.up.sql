@@ -0,0 +1,31 @@
+-- every balance movement is written as two legs sharing an idempotency key:
+-- the user's own account and the counter account (accruals, withdrawals or adjustments),
+-- so the amounts of one movement always sum to zero
+CREATE TABLE IF NOT EXISTS ledger (
+    id_entry        BIGSERIAL PRIMARY KEY,
+    id_user         INT NOT NULL,
+    account         TEXT NOT NULL,
+    id_order        bigint,
+    kind            TEXT NOT NULL CHECK (kind IN ('accrual', 'withdrawal', 'adjustment', 'reversal')),
+    amount          BIGINT NOT NULL,
+    created_at      TIMESTAMP NOT NULL DEFAULT now(),
+    idempotency_key TEXT NOT NULL,
+    UNIQUE (idempotency_key, account)
+);
+CREATE INDEX IF NOT EXISTS ledger_id_user_idx ON ledger (id_user, account);
+
+-- opening entries for balances that existed before the ledger
+INSERT INTO ledger (id_user, account, kind, amount, idempotency_key)
+SELECT id_user, leg.account, 'accrual', leg.sign * accruals, 'opening-accrual:' || id_user
+FROM balance, (VALUES ('user', 1), ('accruals', -1)) AS leg(account, sign)
+WHERE accruals <> 0;
+
+INSERT INTO ledger (id_user, account, kind, amount, idempotency_key)
+SELECT id_user, leg.account, 'withdrawal', -leg.sign * withdrawn, 'opening-withdrawal:' || id_user
+FROM balance, (VALUES ('user', 1), ('withdrawals', -1)) AS leg(account, sign)
+WHERE withdrawn <> 0;
+
+INSERT INTO ledger (id_user, account, kind, amount, idempotency_key)
+SELECT id_user, leg.account, 'adjustment', leg.sign * (current - accruals + withdrawn), 'opening-adjustment:' || id_user
+FROM balance, (VALUES ('user', 1), ('adjustments', -1)) AS leg(account, sign)
+WHERE current - accruals + withdrawn <> 0;
@@ -0,0 +1,15 @@
+-- id_session is the sha256 of the refresh token handed to the client
+CREATE TABLE IF NOT EXISTS sessions (
+    id_session TEXT PRIMARY KEY,
+    id_user    INT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS sessions_id_user_idx ON sessions (id_user);
+
+-- access tokens revoked before their expiry, rows are useless once expires_at has passed
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti        TEXT PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE users ALTER COLUMN id_user DROP IDENTITY IF EXISTS;
@@ -0,0 +1,2 @@
+ALTER TABLE users ALTER COLUMN id_user ADD GENERATED BY DEFAULT AS IDENTITY;
+SELECT setval(pg_get_serial_sequence('users', 'id_user'), COALESCE((SELECT MAX(id_user) FROM users), 0) + 1, false);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS orders_queue_idx;
+ALTER TABLE orders DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE orders DROP COLUMN IF EXISTS locked_by;
+ALTER TABLE orders DROP COLUMN IF EXISTS attempts;
+ALTER TABLE orders DROP COLUMN IF EXISTS next_attempt_at;
@@ -0,0 +1,8 @@
+-- orders waiting for the accrual system are claimed by workers with FOR UPDATE SKIP LOCKED,
+-- locked_until lets another instance take over the order if its worker dies
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP NOT NULL DEFAULT now();
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS locked_by TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
+CREATE INDEX IF NOT EXISTS orders_queue_idx ON orders (next_attempt_at)
+    WHERE state IN ('NEW', 'REGISTERED', 'PROCESSING');
@@ -0,0 +1 @@
+ALTER TABLE balance DROP CONSTRAINT IF EXISTS balance_current_non_negative;
@@ -0,0 +1,4 @@
+-- NOT VALID keeps the migration from failing on balances overdrawn before withdrawals were made atomic,
+-- new writes are checked right away. Fix such rows with the reconcile command, then run
+-- ALTER TABLE balance VALIDATE CONSTRAINT balance_current_non_negative;
+ALTER TABLE balance ADD CONSTRAINT balance_current_non_negative CHECK (current >= 0) NOT VALID;
@@ -0,0 +1,6 @@
+-- fails if an order number doesn't fit into bigint, such rows have to be removed first
+ALTER TABLE ledger ALTER COLUMN id_order TYPE BIGINT USING id_order::BIGINT;
+ALTER TABLE withdraws DROP CONSTRAINT IF EXISTS withdraws_id_order_digits;
+ALTER TABLE withdraws ALTER COLUMN id_order TYPE BIGINT USING id_order::BIGINT;
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_id_order_digits;
+ALTER TABLE orders ALTER COLUMN id_order TYPE BIGINT USING id_order::BIGINT;
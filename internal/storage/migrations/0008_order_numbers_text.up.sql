@@ -0,0 +1,6 @@
+-- order numbers are digit strings of any length, leading zeros included
+ALTER TABLE orders ALTER COLUMN id_order TYPE TEXT USING id_order::TEXT;
+ALTER TABLE orders ADD CONSTRAINT orders_id_order_digits CHECK (id_order ~ '^[0-9]+$');
+ALTER TABLE withdraws ALTER COLUMN id_order TYPE TEXT USING id_order::TEXT;
+ALTER TABLE withdraws ADD CONSTRAINT withdraws_id_order_digits CHECK (id_order ~ '^[0-9]+$');
+ALTER TABLE ledger ALTER COLUMN id_order TYPE TEXT USING id_order::TEXT;
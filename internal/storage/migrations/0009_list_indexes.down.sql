@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS withdraws_id_user_processed_at_idx;
+DROP INDEX IF EXISTS orders_id_user_uploaded_at_idx;
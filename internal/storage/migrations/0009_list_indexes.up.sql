@@ -0,0 +1,3 @@
+-- order and withdrawal lists are paged by time within one user, id_order breaks ties between equal timestamps
+CREATE INDEX IF NOT EXISTS orders_id_user_uploaded_at_idx ON orders (id_user, uploaded_at, id_order);
+CREATE INDEX IF NOT EXISTS withdraws_id_user_processed_at_idx ON withdraws (id_user, processed_at, id_order);
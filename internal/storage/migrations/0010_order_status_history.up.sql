@@ -0,0 +1,11 @@
+-- every state change applied by UpdateOrderAccrual, orders uploaded before this migration
+-- only have the changes made after it
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id_entry   BIGSERIAL PRIMARY KEY,
+    id_order   TEXT NOT NULL,
+    old_state  TEXT NOT NULL,
+    new_state  TEXT NOT NULL,
+    accrual    BIGINT NOT NULL DEFAULT 0,
+    changed_at TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS order_status_history_id_order_idx ON order_status_history (id_order, id_entry);
@@ -0,0 +1,2 @@
+ALTER TABLE withdraws ALTER COLUMN processed_at TYPE TIMESTAMP;
+ALTER TABLE orders ALTER COLUMN uploaded_at TYPE TIMESTAMP;
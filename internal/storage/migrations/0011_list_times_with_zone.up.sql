@@ -0,0 +1,5 @@
+-- upload and withdrawal times were written as the app host's wall clock with the zone dropped,
+-- so list filters sent as instants missed by the host's UTC offset. Existing rows are read in
+-- the session TimeZone, run this with TimeZone (or PGTZ) set to the zone of the host that wrote them
+ALTER TABLE orders ALTER COLUMN uploaded_at TYPE TIMESTAMPTZ;
+ALTER TABLE withdraws ALTER COLUMN processed_at TYPE TIMESTAMPTZ;
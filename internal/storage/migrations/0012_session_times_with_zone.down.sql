@@ -0,0 +1,5 @@
+ALTER TABLE revoked_tokens ALTER COLUMN expires_at TYPE TIMESTAMP;
+ALTER TABLE sessions
+    ALTER COLUMN created_at TYPE TIMESTAMP,
+    ALTER COLUMN expires_at TYPE TIMESTAMP,
+    ALTER COLUMN revoked_at TYPE TIMESTAMP;
@@ -0,0 +1,8 @@
+-- session and denylist times were written as the app host's wall clock with the zone dropped and read
+-- back as UTC, so refresh tokens expired early or late by the host's UTC offset. Existing rows are read
+-- in the session TimeZone, run this with TimeZone (or PGTZ) set to the zone of the host that wrote them
+ALTER TABLE sessions
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN expires_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN revoked_at TYPE TIMESTAMPTZ;
+ALTER TABLE revoked_tokens ALTER COLUMN expires_at TYPE TIMESTAMPTZ;
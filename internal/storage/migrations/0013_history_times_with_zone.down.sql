@@ -0,0 +1 @@
+ALTER TABLE order_status_history ALTER COLUMN changed_at TYPE TIMESTAMP;
@@ -0,0 +1,2 @@
+-- changed_at was filled by now() in the session TimeZone, existing rows convert from that same zone
+ALTER TABLE order_status_history ALTER COLUMN changed_at TYPE TIMESTAMPTZ;
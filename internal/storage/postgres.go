@@ -0,0 +1,850 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/logging"
+	"github.com/valentinaskakun/gophermart/internal/passwords"
+
+	"github.com/jackc/pgx"
+	_ "github.com/jackc/pgx/stdlib"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PostgresStorage keeps a single connection pool for the lifetime of the process
+type PostgresStorage struct {
+	db       *sql.DB
+	timeouts operationTimeouts
+}
+
+// operationTimeouts bound a single storage call on top of the caller's context
+type operationTimeouts struct {
+	query   time.Duration
+	write   time.Duration
+	report  time.Duration
+	migrate time.Duration
+}
+
+func NewPostgresStorage(configRun *config.Config) (*PostgresStorage, error) {
+	db, err := sql.Open("pgx", configRun.Database)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func": "NewPostgresStorage.sql.Open()",
+		}).Error(err)
+		return nil, err
+	}
+	db.SetMaxOpenConns(configRun.DBMaxOpenConns)
+	db.SetMaxIdleConns(configRun.DBMaxIdleConns)
+	db.SetConnMaxLifetime(configRun.DBConnMaxLifetime)
+	db.SetConnMaxIdleTime(configRun.DBConnMaxIdleTime)
+	ctx, cancel := context.WithTimeout(context.Background(), configRun.DBQueryTimeout)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		log.WithFields(log.Fields{
+			"func": "NewPostgresStorage.db.PingContext()",
+		}).Error(err)
+		db.Close()
+		return nil, err
+	}
+	return &PostgresStorage{
+		db: db,
+		timeouts: operationTimeouts{
+			query:   configRun.DBQueryTimeout,
+			write:   configRun.DBWriteTimeout,
+			report:  configRun.DBReportTimeout,
+			migrate: configRun.DBMigrateTimeout,
+		},
+	}, nil
+}
+
+func (s *PostgresStorage) Close() error {
+	return s.db.Close()
+}
+
+// isUniqueViolation reports whether err is a unique_violation (SQLSTATE 23505) raised by Postgres
+func isUniqueViolation(err error) bool {
+	var pgErr pgx.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func (s *PostgresStorage) Migrator() (*Migrator, error) {
+	migrator, err := NewMigrator(s.db)
+	if err != nil {
+		return nil, err
+	}
+	migrator.timeout = s.timeouts.migrate
+	return migrator, nil
+}
+
+// Migrate applies every pending schema migration
+func (s *PostgresStorage) Migrate(ctx context.Context) (err error) {
+	migrator, err := s.Migrator()
+	if err != nil {
+		return
+	}
+	return migrator.Up(ctx, 0)
+}
+
+func (s *PostgresStorage) InsertUser(ctx context.Context, userAuthInfo *CredUserStruct) (userID int, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "InsertUser.db.BeginTx()",
+		}).Error(err)
+		return userID, errors.Wrap(err, "could not start a new transaction")
+	}
+	defer txn.Rollback()
+	var newID int
+	err = txn.QueryRowContext(ctx, PostgresDBRun.queryInsertUser, userAuthInfo.Login, userAuthInfo.Password).Scan(&newID)
+	if isUniqueViolation(err) {
+		return userID, ErrLoginExists
+	}
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "InsertUser.txn.QueryRowContext(PostgresDBRun.queryInsertUser)" + userAuthInfo.Login,
+		}).Error(err)
+		return userID, errors.Wrap(err, "failed to insert the user")
+	}
+	_, err = txn.ExecContext(ctx, PostgresDBRun.queryInsertUserBalance, newID)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "InsertUser.txn.Exec(PostgresDBRun.queryInsertUserBalance, newID)",
+		}).Error(err)
+		return userID, errors.Wrap(err, "failed to insert the user balance")
+	}
+	if err := txn.Commit(); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "InsertUser.txn.Commit()",
+		}).Error(err)
+		return userID, errors.Wrap(err, "failed to commit transaction")
+	}
+	userID = newID
+	return
+}
+
+func (s *PostgresStorage) ReturnPasswordByLogin(ctx context.Context, login *string) (password string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.query)
+	defer cancel()
+	err = s.db.QueryRowContext(ctx, PostgresDBRun.queryCheckPassword, login).Scan(&password)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnPasswordByLogin.PostgresDBRun.queryCheckPassword " + *login,
+		}).Error(err)
+		return
+	}
+	return
+}
+
+func (s *PostgresStorage) UpdateUserPassword(ctx context.Context, login *string, password string) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, PostgresDBRun.queryUpdatePassword, login, password)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "UpdateUserPassword.PostgresDBRun.queryUpdatePassword " + *login,
+		}).Error(err)
+		return
+	}
+	return
+}
+
+func (s *PostgresStorage) CountLegacyPasswords(ctx context.Context) (total int, legacy int, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.report)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, PostgresDBRun.querySelectPasswords)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "CountLegacyPasswords.PostgresDBRun.querySelectPasswords",
+		}).Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var password string
+		if err = rows.Scan(&password); err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "CountLegacyPasswords.Scan",
+			}).Error(err)
+			return
+		}
+		total++
+		if passwords.IsLegacy(password) {
+			legacy++
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *PostgresStorage) ReturnIDByLogin(ctx context.Context, login *string) (userAuthInfo UsingUserStruct, err error) {
+	userAuthInfo.Login = *login
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.query)
+	defer cancel()
+	var countByLogin int
+	err = s.db.QueryRowContext(ctx, PostgresDBRun.querySelectCountByLogin, login).Scan(&countByLogin)
+	if err != nil || countByLogin == 0 {
+		userAuthInfo.IDUser = 0
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnIDByLogin.PostgresDBRun.querySelectCountByLogin" + *login,
+		}).Error(err)
+		return
+	}
+	err = s.db.QueryRowContext(ctx, PostgresDBRun.querySelectIDByLogin, login).Scan(&userAuthInfo.IDUser)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnIDByLogin.PostgresDBRun.querySelectIDByLogin" + *login,
+		}).Error(err)
+		return
+	}
+	return
+}
+
+func (s *PostgresStorage) InsertOrder(ctx context.Context, order *UsingOrderStruct) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, PostgresDBRun.queryInsertOrder, order.Number, order.IDUser, order.State, 0, order.UploadedAt)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "InsertOrder.PostgresDBRun.queryInsertOrder ",
+		}).Error(err)
+		return err
+	}
+	return
+}
+
+// InsertOrders adds every order in one transaction, numbers that already exist are left as they are
+// and reported with their current owner
+func (s *PostgresStorage) InsertOrders(ctx context.Context, arrOrders []UsingOrderStruct) (arrResults []InsertedOrderStruct, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "InsertOrders.db.BeginTx()",
+		}).Error(err)
+		return
+	}
+	defer txn.Rollback()
+	arrResults = make([]InsertedOrderStruct, 0, len(arrOrders))
+	for _, order := range arrOrders {
+		result := InsertedOrderStruct{Number: order.Number, IDUser: order.IDUser}
+		res, err := txn.ExecContext(ctx, PostgresDBRun.queryInsertOrderIfAbsent, order.Number, order.IDUser, order.State, order.UploadedAt)
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "InsertOrders.PostgresDBRun.queryInsertOrderIfAbsent",
+			}).Error(err)
+			return nil, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "InsertOrders.RowsAffected",
+			}).Error(err)
+			return nil, err
+		}
+		result.Inserted = rows > 0
+		if !result.Inserted {
+			err = txn.QueryRowContext(ctx, PostgresDBRun.querySelectOrderOwner, order.Number).Scan(&result.IDUser)
+			if err != nil {
+				logging.FromContext(ctx).WithFields(log.Fields{
+					"func": "InsertOrders.PostgresDBRun.querySelectOrderOwner",
+				}).Error(err)
+				return nil, err
+			}
+		}
+		arrResults = append(arrResults, result)
+	}
+	if err = txn.Commit(); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "InsertOrders.txn.Commit()",
+		}).Error(err)
+		return nil, err
+	}
+	return
+}
+
+func (s *PostgresStorage) NewWithdraw(ctx context.Context, order *OrderToWithdrawStruct, userID *int) (isBalance bool, result bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw.db.BeginTx()",
+		}).Error(err)
+		return
+	}
+	defer txn.Rollback()
+	// locking the balance row serializes withdrawals of the same user, so a retried withdrawal
+	// sees the committed first attempt and is reported as a repeat even when the balance fell below the sum
+	if _, err = txn.ExecContext(ctx, PostgresDBRun.queryLockBalance, userID); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw.queryLockBalance",
+		}).Error(err)
+		return
+	}
+	var exists bool
+	if err = txn.QueryRowContext(ctx, PostgresDBRun.querySelectWithdrawExists, order.IDOrder).Scan(&exists); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw.querySelectWithdrawExists",
+		}).Error(err)
+		return
+	}
+	if exists {
+		err = ErrWithdrawalExists
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw.querySelectWithdrawExists",
+		}).Error(err)
+		return
+	}
+	// the balance check and the debit are one conditional UPDATE, it can't overdraw the balance
+	res, err := txn.ExecContext(ctx, PostgresDBRun.queryUpdateDecreaseBalance, userID, order.Sum)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw.queryUpdateDecreaseBalance failed",
+		}).Error(err)
+		return
+	}
+	debited, err := res.RowsAffected()
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw.RowsAffected()",
+		}).Error(err)
+		return
+	}
+	if debited == 0 {
+		isBalance = false
+		result = true
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw balance < sum",
+		}).Info()
+		return
+	}
+	isBalance = true
+	applied, err := insertLedgerEntry(ctx, txn, withdrawalLedgerEntry(*userID, order.IDOrder, order.Sum))
+	if err == nil && !applied {
+		err = ErrWithdrawalExists
+	}
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw.insertLedgerEntry",
+		}).Error(err)
+		return
+	}
+	_, err = txn.ExecContext(ctx, PostgresDBRun.queryInsertWithdraw, order.IDOrder, userID, order.Sum, time.Now())
+	if isUniqueViolation(err) {
+		err = ErrWithdrawalExists
+	}
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw.queryInsertWithdraw",
+		}).Error(err)
+		return
+	}
+	if err = txn.Commit(); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "NewWithdraw.txn.Commit()",
+		}).Error(err)
+		return
+	}
+	result = true
+	return
+}
+
+func (s *PostgresStorage) ReturnOrdersInfoByUserID(ctx context.Context, userID int, filter *ListFilter) (isOrders bool, arrOrders []UsingOrderStruct, page ListPage, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.query)
+	defer cancel()
+	query, args, count, countArgs := listQuery(PostgresDBRun.querySelectOrderByUserID, PostgresDBRun.querySelectCountOrdersByUser,
+		"uploaded_at", "id_order", filter, userID)
+	txn, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnOrdersInfoByUserID.db.BeginTx()",
+		}).Error(err)
+		return
+	}
+	defer txn.Rollback()
+	err = txn.QueryRowContext(ctx, count, countArgs...).Scan(&page.Total)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnOrdersInfoByUserID.PostgresDBRun.querySelectCountOrdersByUser",
+		}).Error(err)
+		return
+	}
+	rows, err := txn.QueryContext(ctx, query, args...)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnOrdersInfoByUserID.PostgresDBRun.querySelectOrderByUserID",
+		}).Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orderInfo UsingOrderStruct
+		err = rows.Scan(&orderInfo.Number, &orderInfo.State, &orderInfo.Accrual, &orderInfo.UploadedAt)
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "ReturnOrdersInfoByUserID.ScanRow failed",
+			}).Error(err)
+			return
+		}
+		arrOrders = append(arrOrders, orderInfo)
+	}
+	if err = rows.Err(); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnOrdersInfoByUserID.rows.Err()",
+		}).Error(err)
+		return
+	}
+	if filter.Limit > 0 && len(arrOrders) > filter.Limit {
+		arrOrders = arrOrders[:filter.Limit]
+		last := arrOrders[len(arrOrders)-1]
+		page.Next = &ListCursor{At: last.UploadedAt, IDOrder: last.Number}
+	}
+	isOrders = len(arrOrders) > 0
+	return
+}
+
+func (s *PostgresStorage) ReturnBalanceByUserID(ctx context.Context, IDUser *int) (userBalanceInfo UsingUserBalanceStruct, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.query)
+	defer cancel()
+	err = s.db.QueryRowContext(ctx, PostgresDBRun.querySelectBalance, IDUser).Scan(&userBalanceInfo.Current, &userBalanceInfo.Accrual, &userBalanceInfo.Withdrawn)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnBalanceByUserID.PostgresDBRun.querySelectBalance ",
+		}).Error(err)
+		return
+	}
+	return
+}
+
+func (s *PostgresStorage) ReturnOrderInfoByID(ctx context.Context, number string) (orderInfo UsingOrderStruct, err error) {
+	var count int
+	orderInfo.Number = number
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.query)
+	defer cancel()
+	err = s.db.QueryRowContext(ctx, PostgresDBRun.querySelectCountOrdersByID, number).Scan(&count)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnOrderInfoByID.PostgresDBRun.querySelectCountOrdersByID ",
+		}).Error(err)
+	}
+	if count != 0 {
+		err = s.db.QueryRowContext(ctx, PostgresDBRun.querySelectOrderInfoByID, number).Scan(&orderInfo.Number, &orderInfo.IDUser, &orderInfo.State, &orderInfo.Accrual, &orderInfo.UploadedAt)
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "ReturnOrderInfoByID.PostgresDBRun.querySelectOrderInfoByID ",
+			}).Error(err)
+		}
+		return
+
+	}
+	return
+}
+
+// ReturnOrderHistory lists the state changes of the order from the oldest
+func (s *PostgresStorage) ReturnOrderHistory(ctx context.Context, number string) (arrHistory []OrderStatusChangeStruct, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.query)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, PostgresDBRun.querySelectOrderHistory, number)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnOrderHistory.PostgresDBRun.querySelectOrderHistory",
+		}).Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change OrderStatusChangeStruct
+		err = rows.Scan(&change.OldState, &change.NewState, &change.Accrual, &change.ChangedAt)
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "ReturnOrderHistory.Scan",
+			}).Error(err)
+			return
+		}
+		arrHistory = append(arrHistory, change)
+	}
+	if err = rows.Err(); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnOrderHistory.rows.Err()",
+		}).Error(err)
+	}
+	return
+}
+
+func (s *PostgresStorage) ReturnWithdrawsInfoByUserID(ctx context.Context, userID *int, filter *ListFilter) (isWithdraws bool, arrWithdraws []UsingWithdrawStruct, page ListPage, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.query)
+	defer cancel()
+	query, args, count, countArgs := listQuery(PostgresDBRun.querySelectWithdrawsByUserID, PostgresDBRun.querySelectCountWithdrawsBy,
+		"processed_at", "id_order", filter, *userID)
+	txn, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnWithdrawsInfoByUserID.db.BeginTx()",
+		}).Error(err)
+		return
+	}
+	defer txn.Rollback()
+	err = txn.QueryRowContext(ctx, count, countArgs...).Scan(&page.Total)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnWithdrawsInfoByUserID.PostgresDBRun.querySelectCountWithdrawsBy",
+		}).Error(err)
+		return
+	}
+	rows, err := txn.QueryContext(ctx, query, args...)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnWithdrawsInfoByUserID.PostgresDBRun.querySelectWithdrawsByUserID ",
+		}).Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var withdrawInfo UsingWithdrawStruct
+		err = rows.Scan(&withdrawInfo.IDOrder, &withdrawInfo.Withdraw, &withdrawInfo.ProcessedAt)
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "ReturnWithdrawsInfoByUserID.PostgresDBRun.querySelectWithdrawsByUserID.Scan ",
+			}).Error(err)
+			return
+		}
+		arrWithdraws = append(arrWithdraws, withdrawInfo)
+	}
+	if err = rows.Err(); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReturnWithdrawsInfoByUserID.rows.Err()",
+		}).Error(err)
+		return
+	}
+	if filter.Limit > 0 && len(arrWithdraws) > filter.Limit {
+		arrWithdraws = arrWithdraws[:filter.Limit]
+		last := arrWithdraws[len(arrWithdraws)-1]
+		page.Next = &ListCursor{At: last.ProcessedAt, IDOrder: last.IDOrder}
+	}
+	isWithdraws = len(arrWithdraws) > 0
+	return
+}
+
+// ClaimOrders locks up to limit due orders for workerID until the lease expires,
+// rows locked by another instance are skipped instead of waited for
+func (s *PostgresStorage) ClaimOrders(ctx context.Context, workerID string, limit int, lease time.Duration) (arrOrders []QueuedOrderStruct, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, PostgresDBRun.queryClaimOrders, workerID, limit, lease.Milliseconds())
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ClaimOrders.PostgresDBRun.queryClaimOrders",
+		}).Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var order QueuedOrderStruct
+		if err = rows.Scan(&order.IDOrder, &order.Attempts); err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "ClaimOrders.Scan",
+			}).Error(err)
+			return
+		}
+		arrOrders = append(arrOrders, order)
+	}
+	if err = rows.Err(); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ClaimOrders.rows.Err()",
+		}).Error(err)
+	}
+	return
+}
+
+// RetryOrder counts a failed attempt and unlocks the order until delay has passed
+func (s *PostgresStorage) RetryOrder(ctx context.Context, orderID string, workerID string, delay time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, PostgresDBRun.queryRetryOrder, orderID, workerID, delay.Milliseconds())
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RetryOrder.PostgresDBRun.queryRetryOrder",
+		}).Error(err)
+	}
+	return
+}
+
+// ReleaseOrder unlocks the order until delay has passed without counting an attempt
+func (s *PostgresStorage) ReleaseOrder(ctx context.Context, orderID string, workerID string, delay time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, PostgresDBRun.queryReleaseOrder, orderID, workerID, delay.Milliseconds())
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "ReleaseOrder.PostgresDBRun.queryReleaseOrder",
+		}).Error(err)
+	}
+	return
+}
+
+// UpdateOrderAccrual moves the order to the state reported by the accrual system, the balance
+// is credited only on the transition into PROCESSED. Repeating the final state is a no-op, illegal
+// transitions return ErrIllegalTransition and a negative accrual returns ErrNegativeAccrual
+func (s *PostgresStorage) UpdateOrderAccrual(ctx context.Context, orderAccrual *UsingAccrualStruct) (err error) {
+	if err = checkAccrual(ctx, orderAccrual); err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "UpdateOrderAccrual.db.BeginTx()",
+		}).Error(err)
+		return
+	}
+	defer txn.Rollback()
+	var userID int
+	var state string
+	err = txn.QueryRowContext(ctx, PostgresDBRun.querySelectOrderForUpdate, orderAccrual.Order).Scan(&userID, &state)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "UpdateOrderAccrual.PostgresDBRun.querySelectOrderForUpdate " + orderAccrual.Order,
+		}).Error(err)
+		return
+	}
+	if state == orderAccrual.Status && IsFinalState(state) {
+		// a redelivered final answer changes nothing, the first accrual stands
+		return nil
+	}
+	if !CanTransition(state, orderAccrual.Status) {
+		return illegalTransition(ctx, orderAccrual.Order, state, orderAccrual.Status)
+	}
+	accrual := orderAccrual.Accrual
+	if orderAccrual.Status != OrderStateProcessed {
+		accrual = 0
+	}
+	res, err := txn.ExecContext(ctx, PostgresDBRun.queryUpdateOrdersAccrual, orderAccrual.Order, orderAccrual.Status, accrual, state)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "UpdateOrderAccrual.PostgresDBRun.queryUpdateOrdersAccrual",
+		}).Error(err)
+		return
+	}
+	if updated, errRows := res.RowsAffected(); errRows != nil || updated == 0 {
+		return illegalTransition(ctx, orderAccrual.Order, state, orderAccrual.Status)
+	}
+	if state != orderAccrual.Status {
+		_, err = txn.ExecContext(ctx, PostgresDBRun.queryInsertOrderHistory, orderAccrual.Order, state, orderAccrual.Status, accrual, time.Now())
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "UpdateOrderAccrual.PostgresDBRun.queryInsertOrderHistory",
+			}).Error(err)
+			return
+		}
+	}
+	if accrual != 0 {
+		applied, errLedger := insertLedgerEntry(ctx, txn, accrualLedgerEntry(userID, orderAccrual.Order, accrual))
+		if errLedger != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "UpdateOrderAccrual.insertLedgerEntry",
+			}).Error(errLedger)
+			return errLedger
+		}
+		if !applied {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "UpdateOrderAccrual accrual is already in the ledger for " + orderAccrual.Order,
+			}).Warn()
+			return txn.Commit()
+		}
+		_, err = txn.ExecContext(ctx, PostgresDBRun.queryUpdateIncreaseBalance, userID, accrual)
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "UpdateOrderAccrual.PostgresDBRun.queryUpdateIncreaseBalance",
+			}).Error(err)
+			return
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "UpdateOrderAccrual.txn.Commit()",
+		}).Error(err)
+		return
+	}
+	return
+}
+
+// insertLedgerEntry writes both legs of a movement, applied is false when the idempotency key
+// has already been used and the balance must not be changed again
+func insertLedgerEntry(ctx context.Context, txn *sql.Tx, entry LedgerEntry) (applied bool, err error) {
+	orderID := sql.NullString{String: entry.IDOrder, Valid: entry.IDOrder != ""}
+	res, err := txn.ExecContext(ctx, PostgresDBRun.queryInsertLedgerEntry, entry.IDUser, ledgerAccountUser, counterAccount(entry.Kind),
+		orderID, entry.Kind, entry.Amount, entry.CreatedAt, entry.IdempotencyKey)
+	if err != nil {
+		return
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	applied = inserted > 0
+	return
+}
+
+func (s *PostgresStorage) Reconcile(ctx context.Context) (mismatches []ReconcileMismatch, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.report)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, PostgresDBRun.querySelectReconcile, ledgerAccountUser, LedgerKindAccrual, LedgerKindReversal, LedgerKindWithdrawal)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "Reconcile.PostgresDBRun.querySelectReconcile",
+		}).Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mismatch ReconcileMismatch
+		err = rows.Scan(&mismatch.IDUser, &mismatch.Current, &mismatch.Accruals, &mismatch.Withdrawn,
+			&mismatch.LedgerCurrent, &mismatch.LedgerAccruals, &mismatch.LedgerWithdrawn)
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"func": "Reconcile.Scan",
+			}).Error(err)
+			return
+		}
+		mismatches = append(mismatches, mismatch)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *PostgresStorage) InsertSession(ctx context.Context, session *SessionStruct) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, PostgresDBRun.queryInsertSession, session.IDSession, session.IDUser, session.CreatedAt, session.ExpiresAt)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "InsertSession.PostgresDBRun.queryInsertSession",
+		}).Error(err)
+		return
+	}
+	return
+}
+
+// RotateSession revokes the old session and inserts the new one for the same user in one transaction,
+// rotated is false when the old session is already revoked or expired
+func (s *PostgresStorage) RotateSession(ctx context.Context, oldSessionID string, session *SessionStruct) (oldSession SessionStruct, rotated bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RotateSession.db.BeginTx()",
+		}).Error(err)
+		return
+	}
+	defer txn.Rollback()
+	oldSession.IDSession = oldSessionID
+	err = txn.QueryRowContext(ctx, PostgresDBRun.querySelectSessionForUpdate, oldSessionID).
+		Scan(&oldSession.IDUser, &oldSession.Login, &oldSession.CreatedAt, &oldSession.ExpiresAt, &oldSession.Revoked)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RotateSession.PostgresDBRun.querySelectSessionForUpdate",
+		}).Error(err)
+		return
+	}
+	if oldSession.Revoked || !oldSession.ExpiresAt.After(time.Now()) {
+		return
+	}
+	if _, err = txn.ExecContext(ctx, PostgresDBRun.queryRevokeSession, oldSessionID, time.Now()); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RotateSession.PostgresDBRun.queryRevokeSession",
+		}).Error(err)
+		return
+	}
+	session.IDUser = oldSession.IDUser
+	session.Login = oldSession.Login
+	_, err = txn.ExecContext(ctx, PostgresDBRun.queryInsertSession, session.IDSession, session.IDUser, session.CreatedAt, session.ExpiresAt)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RotateSession.PostgresDBRun.queryInsertSession",
+		}).Error(err)
+		return
+	}
+	if err = txn.Commit(); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RotateSession.txn.Commit()",
+		}).Error(err)
+		return
+	}
+	rotated = true
+	return
+}
+
+func (s *PostgresStorage) RevokeSession(ctx context.Context, sessionID string) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, PostgresDBRun.queryRevokeSession, sessionID, time.Now())
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RevokeSession.PostgresDBRun.queryRevokeSession",
+		}).Error(err)
+		return
+	}
+	return
+}
+
+func (s *PostgresStorage) RevokeUserSessions(ctx context.Context, userID int) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, PostgresDBRun.queryRevokeUserSessions, userID, time.Now())
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RevokeUserSessions.PostgresDBRun.queryRevokeUserSessions",
+		}).Error(err)
+		return
+	}
+	return
+}
+
+// RevokeToken puts an access token on the denylist until it expires and drops entries that already expired
+func (s *PostgresStorage) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.write)
+	defer cancel()
+	if _, err = s.db.ExecContext(ctx, PostgresDBRun.queryDeleteRevokedTokens, time.Now()); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RevokeToken.PostgresDBRun.queryDeleteRevokedTokens",
+		}).Error(err)
+		return
+	}
+	_, err = s.db.ExecContext(ctx, PostgresDBRun.queryInsertRevokedToken, jti, expiresAt)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "RevokeToken.PostgresDBRun.queryInsertRevokedToken",
+		}).Error(err)
+		return
+	}
+	return
+}
+
+func (s *PostgresStorage) IsTokenRevoked(ctx context.Context, jti string) (revoked bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.query)
+	defer cancel()
+	err = s.db.QueryRowContext(ctx, PostgresDBRun.querySelectTokenRevoked, jti).Scan(&revoked)
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "IsTokenRevoked.PostgresDBRun.querySelectTokenRevoked",
+		}).Error(err)
+		return
+	}
+	return
+}
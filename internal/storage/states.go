@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/valentinaskakun/gophermart/internal/logging"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OrderStateNew        = "NEW"
+	OrderStateRegistered = "REGISTERED"
+	OrderStateProcessing = "PROCESSING"
+	OrderStateProcessed  = "PROCESSED"
+	OrderStateInvalid    = "INVALID"
+)
+
+var (
+	ErrIllegalTransition = errors.New("illegal order state transition")
+	ErrNegativeAccrual   = errors.New("negative accrual")
+)
+
+// orderTransitions lists the states an order may move to, PROCESSED and INVALID are final
+var orderTransitions = map[string][]string{
+	OrderStateNew:        {OrderStateRegistered, OrderStateProcessing, OrderStateProcessed, OrderStateInvalid},
+	OrderStateRegistered: {OrderStateProcessing, OrderStateProcessed, OrderStateInvalid},
+	OrderStateProcessing: {OrderStateProcessed, OrderStateInvalid},
+}
+
+var illegalTransitions int64
+
+// CanTransition reports whether an order in state from may be moved to state to,
+// repeating the current state of an unfinished order is allowed and changes nothing.
+// Final states never move, UpdateOrderAccrual treats a repeated final state as a no-op before asking
+func CanTransition(from string, to string) bool {
+	next, ok := orderTransitions[from]
+	if !ok {
+		return false
+	}
+	if from == to {
+		return true
+	}
+	for _, state := range next {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOrderState reports whether state is one of the order states
+func IsOrderState(state string) bool {
+	_, ok := orderTransitions[state]
+	return ok || IsFinalState(state)
+}
+
+// IsFinalState reports whether the accrual system is done with the order
+func IsFinalState(state string) bool {
+	return state == OrderStateProcessed || state == OrderStateInvalid
+}
+
+// IllegalTransitions returns how many transitions were rejected since start
+func IllegalTransitions() int64 {
+	return atomic.LoadInt64(&illegalTransitions)
+}
+
+func countIllegalTransition() int64 {
+	return atomic.AddInt64(&illegalTransitions, 1)
+}
+
+// illegalTransition counts and logs a rejected transition and returns ErrIllegalTransition
+func illegalTransition(ctx context.Context, order string, from string, to string) error {
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"func":  "illegalTransition order " + order + " " + from + " -> " + to,
+		"total": countIllegalTransition(),
+	}).Warn(ErrIllegalTransition)
+	return ErrIllegalTransition
+}
+
+// checkAccrual rejects updates that would take points away, a reversal is never an accrual
+func checkAccrual(ctx context.Context, orderAccrual *UsingAccrualStruct) error {
+	if orderAccrual.Accrual < 0 {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"func": "checkAccrual order " + orderAccrual.Order + " accrual " + orderAccrual.Accrual.String(),
+		}).Warn(ErrNegativeAccrual)
+		return ErrNegativeAccrual
+	}
+	return nil
+}
@@ -2,16 +2,19 @@ package storage
 
 import (
 	"context"
-	"database/sql"
-	"strconv"
 	"time"
 
 	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/money"
 
-	"github.com/dgrijalva/jwt-go"
-	_ "github.com/jackc/pgx/stdlib"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrLoginExists = errors.New("login already exists")
+	// ErrWithdrawalExists is returned by NewWithdraw when the order number was already used for a withdrawal
+	ErrWithdrawalExists = errors.New("withdrawal already exists")
 )
 
 type CredUserStruct struct {
@@ -21,450 +24,99 @@ type CredUserStruct struct {
 type UsingUserStruct struct {
 	IDUser int    `json:"id_user" ,db:"id_user"`
 	Login  string `json:"login" ,db:"login"`
-	jwt.StandardClaims
 }
 type UsingUserBalanceStruct struct {
-	IDUser    int     `json:"id_user" ,db:"id_user"`
-	Current   float64 `json:"current" ,db:"current"`
-	Accrual   float64 `db:"accruals"`
-	Withdrawn float64 `json:"withdrawn" ,db:"withdrawn"`
+	IDUser    int          `json:"id_user" ,db:"id_user"`
+	Current   money.Amount `json:"current" ,db:"current"`
+	Accrual   money.Amount `db:"accruals"`
+	Withdrawn money.Amount `json:"withdrawn" ,db:"withdrawn"`
 }
 type OrderToWithdrawStruct struct {
-	IDOrder string  `json:"order,omitempty" ,db:"id_order"`
-	Sum     float64 `json:"sum,omitempty" ,db:"sum"`
+	IDOrder string       `json:"order,omitempty" ,db:"id_order"`
+	Sum     money.Amount `json:"sum,omitempty" ,db:"sum"`
 }
 type UsingOrderStruct struct {
-	IDOrder    int       `json:"id_order,omitempty"`
-	Number     string    `json:"number,omitempty" ,db:"id_order"`
-	IDUser     int       `json:"id_user,omitempty" ,db:"id_user"`
-	State      string    `json:"status,omitempty" ,db:"state"`
-	Accrual    float64   `json:"accrual,omitempty" ,db:"accrual"`
-	UploadedAt time.Time `json:"uploaded_at,omitempty" ,db:"uploaded_at"`
+	Number     string       `json:"number,omitempty" ,db:"id_order"`
+	IDUser     int          `json:"id_user,omitempty" ,db:"id_user"`
+	State      string       `json:"status,omitempty" ,db:"state"`
+	Accrual    money.Amount `json:"accrual,omitempty" ,db:"accrual"`
+	UploadedAt time.Time    `json:"uploaded_at,omitempty" ,db:"uploaded_at"`
 }
 type UsingAccrualStruct struct {
-	Order   string  `json:"order" ,db:"id_order"`
-	Status  string  `json:"status" ,db:"state"`
-	Accrual float64 `json:"accrual,omitempty" ,db:"accrual"`
+	Order   string       `json:"order" ,db:"id_order"`
+	Status  string       `json:"status" ,db:"state"`
+	Accrual money.Amount `json:"accrual,omitempty" ,db:"accrual"`
 }
 type UsingWithdrawStruct struct {
-	IDOrder     string    `json:"order" ,db:"id_order"`
-	Withdraw    float64   `json:"sum" ,db:"withdraw"`
-	ProcessedAt time.Time `json:"processed_at,omitempty" ,db:"processed_at"`
-}
-
-func InitTables(config *config.Config) (err error) {
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "InitTables.sql.Open",
-		}).Error(err)
-		return err
-	} else {
-		defer db.Close()
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
-		_, err := db.ExecContext(ctx, PostgresDBRun.queryInitUsers)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "InitTables.ExecContext.PostgresDBRun.queryInitUsers",
-			}).Error(err)
-			return err
-		}
-		_, err = db.ExecContext(ctx, PostgresDBRun.queryInitOrders)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "InitTables.ExecContext.PostgresDBRun.queryInitOrders",
-			}).Error(err)
-			return err
-		}
-		_, err = db.ExecContext(ctx, PostgresDBRun.queryInitBalance)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "InitTables.ExecContext.PostgresDBRun.queryInitBalance",
-			}).Error(err)
-			return err
-		}
-		_, err = db.ExecContext(ctx, PostgresDBRun.queryInitWithdraws)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "InitTables.ExecContext.PostgresDBRun.queryInitWithdraws",
-			}).Error(err)
-			return err
-		}
-	}
-	return
-}
-
-func InsertUser(config *config.Config, userAuthInfo *CredUserStruct) (userID int, err error) {
-	var maxID int
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "InsertUser.db.sql.Open()",
-		}).Error(err)
-		return
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	err = db.QueryRowContext(ctx, PostgresDBRun.querySelectMaxIDUsers).Scan(&maxID)
-	//todo: выпилить костыль NULL
-	if err != nil {
-		var count int
-		err2 := db.QueryRowContext(ctx, PostgresDBRun.querySelectCountUsers).Scan(&count)
-		if err2 == nil {
-			if count == 0 {
-				maxID = 0
-				err = nil
-			}
-		} else {
-			return
-		}
-	}
-	newID := maxID + 1
-	txn, err := db.Begin()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "InsertUser.db.Begin()",
-		}).Error(err)
-		return userID, errors.Wrap(err, "could not start a new transaction")
-	}
-	defer txn.Rollback()
-	_, err = txn.Exec(PostgresDBRun.queryInsertUser, newID, userAuthInfo.Login, userAuthInfo.Password)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "InsertUser.txn.Exec(PostgresDBRun.queryInsertUser)" + userAuthInfo.Login,
-		}).Error(err)
-		return userID, errors.Wrap(err, "failed to insert multiple records at once")
-	}
-	_, err = txn.Exec(PostgresDBRun.queryInsertUserBalance, newID)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "InsertUser.txn.Exec(PostgresDBRun.queryInsertUserBalance, newID)",
-		}).Error(err)
-		return userID, errors.Wrap(err, "failed to insert multiple records at once")
-	}
-	if err := txn.Commit(); err != nil {
-		log.WithFields(log.Fields{
-			"func": "InsertUser.txn.Commit()",
-		}).Error(err)
-		return userID, errors.Wrap(err, "failed to commit transaction")
-	}
-	userID = newID
-	return
-
-}
-
-func CheckUserPass(config *config.Config, userAuthInfo *CredUserStruct) (result bool, err error) {
-	var pass string
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "CheckUserPass.db.sql.Open()",
-		}).Error(err)
-		return
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	err = db.QueryRowContext(ctx, PostgresDBRun.queryCheckPassword, userAuthInfo.Login).Scan(&pass)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "CheckUserPass.db.QueryRowContext(ctx, PostgresDBRun.queryCheckPassword, userAuthInfo.Login)" + userAuthInfo.Login,
-		}).Error(err)
-		return
-	}
-	if userAuthInfo.Password == pass {
-		result = true
-		return
-	}
-	result = false
-	log.WithFields(log.Fields{
-		"func": "CheckUserPass passwords don't match for" + userAuthInfo.Login,
-	}).Info()
-	return
-}
-
-func ReturnIDByLogin(config *config.Config, login *string) (userAuthInfo UsingUserStruct, err error) {
-	userAuthInfo.Login = *login
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnIDByLogin.db.sql.Open()",
-		}).Error(err)
-		return
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	var countByLogin int
-	err = db.QueryRowContext(ctx, PostgresDBRun.querySelectCountByLogin, login).Scan(&countByLogin)
-	if err != nil || countByLogin == 0 {
-		userAuthInfo.IDUser = 0
-		log.WithFields(log.Fields{
-			"func": "ReturnIDByLogin.PostgresDBRun.querySelectCountByLogin" + *login,
-		}).Error(err)
-		return
-	}
-	err = db.QueryRowContext(ctx, PostgresDBRun.querySelectIDByLogin, login).Scan(&userAuthInfo.IDUser)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnIDByLogin.PostgresDBRun.querySelectIDByLogin" + *login,
-		}).Error(err)
-		return
-	}
-	return
-}
-
-func InsertOrder(config *config.Config, order *UsingOrderStruct) (err error) {
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "InsertOrder.sql.Open()",
-		}).Error(err)
-		return err
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	_, err = db.ExecContext(ctx, PostgresDBRun.queryInsertOrder, order.IDOrder, order.IDUser, order.State, 0, order.UploadedAt)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "InsertOrder.PostgresDBRun.queryInsertOrder ",
-		}).Error(err)
-		return err
-	}
-	return
-}
-
-func NewWithdraw(config *config.Config, order *OrderToWithdrawStruct, userID *int) (isBalance bool, result bool, err error) {
-	var userBalanceInfo UsingUserBalanceStruct
-	orderParsed, err := strconv.Atoi(order.IDOrder)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "NewWithdraw.strconv.Atoi(order.IDOrder)",
-		}).Error(err)
-		return
-	}
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "NewWithdraw.sql.Open()",
-		}).Error(err)
-		return
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	txn, err := db.Begin()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "NewWithdraw.db.Begin()",
-		}).Error(err)
-		return
-	}
-	defer txn.Rollback()
-	err = txn.QueryRowContext(ctx, PostgresDBRun.querySelectBalance, userID).Scan(&userBalanceInfo.Current, &userBalanceInfo.Accrual, &userBalanceInfo.Withdrawn)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "NewWithdraw.PostgresDBRun.querySelectBalance",
-		}).Error(err)
-		return
-	}
-	if userBalanceInfo.Current < order.Sum {
-		isBalance = false
-		result = true
-		log.WithFields(log.Fields{
-			"func": "NewWithdraw.userBalanceInfo balance < sum",
-		}).Info()
-		return
-	}
-	isBalance = true
-	_, err = txn.ExecContext(ctx, PostgresDBRun.queryUpdateDecreaseBalance, userID, order.Sum)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "NewWithdraw.queryUpdateDecreaseBalance failed",
-		}).Error(err)
-		return
-	}
-	_, err = txn.ExecContext(ctx, PostgresDBRun.queryInsertWithdraw, orderParsed, userID, order.Sum, time.Now())
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "NewWithdraw.queryInsertWithdraw",
-		}).Error(err)
-		return
-	}
-	if err = txn.Commit(); err != nil {
-		log.WithFields(log.Fields{
-			"func": "NewWithdraw.txn.Commit()",
-		}).Error(err)
-		return
-	}
-	result = true
-	return
-}
-
-func ReturnOrdersInfoByUserID(config *config.Config, userID int) (isOrders bool, arrOrders []UsingOrderStruct, err error) {
-	var orderInfo UsingOrderStruct
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnOrdersInfoByUserID.sql.Open()",
-		}).Error(err)
-		return
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	rows, err := db.QueryContext(ctx, PostgresDBRun.querySelectOrderByUserID, userID)
-	if err != nil || rows.Err() != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnOrdersInfoByUserID.PostgresDBRun.querySelectOrderByUserID",
-		}).Error(err)
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		err = rows.Scan(&orderInfo.Number, &orderInfo.State, &orderInfo.Accrual, &orderInfo.UploadedAt)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "ReturnOrdersInfoByUserID.ScanRow failed",
-			}).Error(err)
-			return
-		}
-		arrOrders = append(arrOrders, orderInfo)
-	}
-	isOrders = true
-	return
-}
-
-func ReturnBalanceByUserID(config *config.Config, IDUser *int) (userBalanceInfo UsingUserBalanceStruct, err error) {
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnBalanceByUserID.sql.Open()",
-		}).Error(err)
-		return
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	err = db.QueryRowContext(ctx, PostgresDBRun.querySelectBalance, IDUser).Scan(&userBalanceInfo.Current, &userBalanceInfo.Accrual, &userBalanceInfo.Withdrawn)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnBalanceByUserID.PostgresDBRun.querySelectBalance ",
-		}).Error(err)
-		return
-	}
-	return
-}
-
-func ReturnOrderInfoByID(config *config.Config, orderID *int) (orderInfo UsingOrderStruct, err error) {
-	var count int
-	orderInfo.IDOrder = *orderID
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnOrderInfoByID.sql.Open()",
-		}).Error(err)
-		return
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	err = db.QueryRowContext(ctx, PostgresDBRun.querySelectCountOrdersByID, orderID).Scan(&count)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnOrderInfoByID.PostgresDBRun.querySelectCountOrdersByID ",
-		}).Error(err)
-	}
-	if count != 0 {
-		err = db.QueryRowContext(ctx, PostgresDBRun.querySelectOrderInfoByID, orderID).Scan(&orderInfo.IDOrder, &orderInfo.IDUser, &orderInfo.State, &orderInfo.Accrual, &orderInfo.UploadedAt)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "ReturnOrderInfoByID.PostgresDBRun.querySelectOrderInfoByID ",
-			}).Error(err)
-		}
-		return
-
-	}
-	return
-}
-
-func ReturnWithdrawsInfoByUserID(config *config.Config, userID *int) (isWithdraws bool, arrWithdraws []UsingWithdrawStruct, err error) {
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnWithdrawsInfoByUserID.sql.Open()",
-		}).Error(err)
-		return
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	rows, err := db.QueryContext(ctx, PostgresDBRun.querySelectWithdrawsByUserID, userID)
-	if err != nil || rows.Err() != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnWithdrawsInfoByUserID.PostgresDBRun.querySelectWithdrawsByUserID ",
-		}).Error(err)
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var withdrawInfo UsingWithdrawStruct
-		err = rows.Scan(&withdrawInfo.IDOrder, &withdrawInfo.Withdraw, &withdrawInfo.ProcessedAt)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "ReturnWithdrawsInfoByUserID.PostgresDBRun.querySelectWithdrawsByUserID.Scan ",
-			}).Error(err)
-			return
-		}
-		arrWithdraws = append(arrWithdraws, withdrawInfo)
-	}
-	isWithdraws = true
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnWithdrawsInfoByUserID",
-		}).Error(err)
-	}
-	return
-}
-func ReturnOrdersToProcess(config *config.Config) (isOrders bool, arrOrders []int, err error) {
-	db, err := sql.Open("pgx", config.Database)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnOrdersToProcess.sql.Open()",
-		}).Error(err)
-		return
-	}
-	defer db.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-	rows, err := db.QueryContext(ctx, PostgresDBRun.querySelectOrdersToProcess)
-	if err != nil || rows.Err() != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnOrdersToProcess.PostgresDBRun.querySelectOrdersToProcess",
-		}).Error(err)
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var orderNum int
-		err = rows.Scan(&orderNum)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"func": "ReturnOrdersToProcess.Scan(&orderNum)",
-			}).Error(err)
-			return
-		}
-		arrOrders = append(arrOrders, orderNum)
-	}
-	if err != nil {
-		log.WithFields(log.Fields{
-			"func": "ReturnOrdersToProcess failed",
-		}).Error(err)
-		return
-	}
-	isOrders = true
-	return
+	IDOrder     string       `json:"order" ,db:"id_order"`
+	Withdraw    money.Amount `json:"sum" ,db:"withdraw"`
+	ProcessedAt time.Time    `json:"processed_at,omitempty" ,db:"processed_at"`
+}
+
+// OrderStatusChangeStruct is one step of an order's timeline, Accrual is the accrual set by the change
+type OrderStatusChangeStruct struct {
+	OldState  string       `json:"old_status"`
+	NewState  string       `json:"new_status"`
+	Accrual   money.Amount `json:"accrual"`
+	ChangedAt time.Time    `json:"changed_at"`
+}
+
+// InsertedOrderStruct tells who owns an order number after InsertOrders and whether this call added it
+type InsertedOrderStruct struct {
+	Number   string
+	IDUser   int
+	Inserted bool
+}
+type QueuedOrderStruct struct {
+	IDOrder  string
+	Attempts int
+}
+type SessionStruct struct {
+	IDSession string
+	IDUser    int
+	Login     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Revoked   bool
+}
+
+// Store covers every operation handlers and the accrual worker need from the storage layer
+type Store interface {
+	Migrate(ctx context.Context) error
+	InsertUser(ctx context.Context, userAuthInfo *CredUserStruct) (userID int, err error)
+	ReturnPasswordByLogin(ctx context.Context, login *string) (password string, err error)
+	UpdateUserPassword(ctx context.Context, login *string, password string) error
+	CountLegacyPasswords(ctx context.Context) (total int, legacy int, err error)
+	ReturnIDByLogin(ctx context.Context, login *string) (userAuthInfo UsingUserStruct, err error)
+	InsertOrder(ctx context.Context, order *UsingOrderStruct) error
+	InsertOrders(ctx context.Context, arrOrders []UsingOrderStruct) (arrResults []InsertedOrderStruct, err error)
+	NewWithdraw(ctx context.Context, order *OrderToWithdrawStruct, userID *int) (isBalance bool, result bool, err error)
+	ReturnOrdersInfoByUserID(ctx context.Context, userID int, filter *ListFilter) (isOrders bool, arrOrders []UsingOrderStruct, page ListPage, err error)
+	ReturnBalanceByUserID(ctx context.Context, IDUser *int) (userBalanceInfo UsingUserBalanceStruct, err error)
+	ReturnOrderInfoByID(ctx context.Context, number string) (orderInfo UsingOrderStruct, err error)
+	ReturnOrderHistory(ctx context.Context, number string) (arrHistory []OrderStatusChangeStruct, err error)
+	ReturnWithdrawsInfoByUserID(ctx context.Context, userID *int, filter *ListFilter) (isWithdraws bool, arrWithdraws []UsingWithdrawStruct, page ListPage, err error)
+	ClaimOrders(ctx context.Context, workerID string, limit int, lease time.Duration) (arrOrders []QueuedOrderStruct, err error)
+	RetryOrder(ctx context.Context, orderID string, workerID string, delay time.Duration) error
+	ReleaseOrder(ctx context.Context, orderID string, workerID string, delay time.Duration) error
+	UpdateOrderAccrual(ctx context.Context, orderAccrual *UsingAccrualStruct) error
+	Reconcile(ctx context.Context) (mismatches []ReconcileMismatch, err error)
+	InsertSession(ctx context.Context, session *SessionStruct) error
+	RotateSession(ctx context.Context, oldSessionID string, session *SessionStruct) (oldSession SessionStruct, rotated bool, err error)
+	RevokeSession(ctx context.Context, sessionID string) error
+	RevokeUserSessions(ctx context.Context, userID int) error
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (revoked bool, err error)
+	Close() error
+}
+
+// New returns the Store selected by configRun.StorageType
+func New(configRun *config.Config) (Store, error) {
+	switch configRun.StorageType {
+	case "", "postgres":
+		return NewPostgresStorage(configRun)
+	case "memory":
+		return NewMemoryStorage(), nil
+	}
+	return nil, errors.Errorf("unknown storage type %q", configRun.StorageType)
 }
@@ -0,0 +1,457 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valentinaskakun/gophermart/internal/config"
+	"github.com/valentinaskakun/gophermart/internal/money"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/pkg/errors"
+)
+
+// testStores returns the memory store and, when DATABASE_URI is set, a migrated Postgres store
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	stores := map[string]Store{"memory": NewMemoryStorage()}
+	if os.Getenv("DATABASE_URI") == "" {
+		return stores
+	}
+	var configRun config.Config
+	if err := env.Parse(&configRun); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresStorage(&configRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err = store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stores["postgres"] = store
+	return stores
+}
+
+// eachStore runs fn against every store from testStores, Postgres is skipped without DATABASE_URI
+func eachStore(t *testing.T, fn func(t *testing.T, store Store)) {
+	stores := testStores(t)
+	for _, name := range []string{"memory", "postgres"} {
+		store, ok := stores[name]
+		t.Run(name, func(t *testing.T) {
+			if !ok {
+				t.Skip("DATABASE_URI is not set")
+			}
+			fn(t, store)
+		})
+	}
+}
+
+// uniqueName keeps logins and order numbers of different runs apart on a shared database
+func uniqueName(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+}
+
+var orderCounter int64
+
+// uniqueOrderNumber returns a digit string no other test run has used
+func uniqueOrderNumber() string {
+	return fmt.Sprintf("%d%04d", time.Now().UnixNano(), atomic.AddInt64(&orderCounter, 1)%10000)
+}
+
+func newTestUser(t *testing.T, store Store) int {
+	t.Helper()
+	userID, err := store.InsertUser(context.Background(), &CredUserStruct{Login: uniqueName("user"), Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+func newTestOrder(t *testing.T, store Store, userID int) string {
+	t.Helper()
+	number := uniqueOrderNumber()
+	err := store.InsertOrder(context.Background(), &UsingOrderStruct{
+		Number:     number,
+		IDUser:     userID,
+		State:      OrderStateNew,
+		UploadedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return number
+}
+
+// fundTestUser credits amount to the user through a processed order, the way real accruals arrive
+func fundTestUser(t *testing.T, store Store, userID int, amount money.Amount) {
+	t.Helper()
+	err := store.UpdateOrderAccrual(context.Background(), &UsingAccrualStruct{
+		Order:   newTestOrder(t, store, userID),
+		Status:  OrderStateProcessed,
+		Accrual: amount,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBalance(t *testing.T, store Store, userID int) UsingUserBalanceStruct {
+	t.Helper()
+	balance, err := store.ReturnBalanceByUserID(context.Background(), &userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func TestInsertUserConcurrent(t *testing.T) {
+	const users = 200
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		prefix := uniqueName("user")
+		ids := make([]int, users)
+		errs := make([]error, users)
+		var wg sync.WaitGroup
+		for i := 0; i < users; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ids[i], errs[i] = store.InsertUser(ctx, &CredUserStruct{
+					Login:    fmt.Sprintf("%s-%d", prefix, i),
+					Password: "hash",
+				})
+			}(i)
+		}
+		wg.Wait()
+		seen := make(map[int]int, users)
+		for i, id := range ids {
+			if errs[i] != nil {
+				t.Fatalf("InsertUser %d: %v", i, errs[i])
+			}
+			if id <= 0 {
+				t.Fatalf("InsertUser %d returned id %d", i, id)
+			}
+			if other, ok := seen[id]; ok {
+				t.Fatalf("users %d and %d got the same id %d", other, i, id)
+			}
+			seen[id] = i
+			login := fmt.Sprintf("%s-%d", prefix, i)
+			stored, err := store.ReturnIDByLogin(ctx, &login)
+			if err != nil || stored.IDUser != id {
+				t.Fatalf("ReturnIDByLogin(%s) = %d, %v, want %d", login, stored.IDUser, err, id)
+			}
+		}
+
+		login := prefix + "-duplicate"
+		var created, exists int
+		var mu sync.Mutex
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := store.InsertUser(ctx, &CredUserStruct{Login: login, Password: "hash"})
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					created++
+				case errors.Is(err, ErrLoginExists):
+					exists++
+				default:
+					t.Errorf("InsertUser duplicate: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if created != 1 || exists != 19 {
+			t.Fatalf("duplicate login: %d created, %d ErrLoginExists, want 1 and 19", created, exists)
+		}
+	})
+}
+
+func TestUpdateOrderAccrualRejectsNegative(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		userID := newTestUser(t, store)
+		order := newTestOrder(t, store, userID)
+		err := store.UpdateOrderAccrual(ctx, &UsingAccrualStruct{Order: order, Status: OrderStateProcessed, Accrual: -400})
+		if !errors.Is(err, ErrNegativeAccrual) {
+			t.Fatalf("negative accrual on a new order: %v, want ErrNegativeAccrual", err)
+		}
+		orderInfo, err := store.ReturnOrderInfoByID(ctx, order)
+		if err != nil || orderInfo.State != OrderStateNew {
+			t.Fatalf("order after a rejected accrual: %s, %v, want NEW", orderInfo.State, err)
+		}
+
+		err = store.UpdateOrderAccrual(ctx, &UsingAccrualStruct{Order: order, Status: OrderStateProcessed, Accrual: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.UpdateOrderAccrual(ctx, &UsingAccrualStruct{Order: order, Status: OrderStateProcessed, Accrual: -400})
+		if !errors.Is(err, ErrNegativeAccrual) {
+			t.Fatalf("negative accrual after PROCESSED: %v, want ErrNegativeAccrual", err)
+		}
+		balance := testBalance(t, store, userID)
+		if balance.Current != 1000 || balance.Accrual != 1000 {
+			t.Fatalf("balance current %s accruals %s, want 10 and 10", balance.Current, balance.Accrual)
+		}
+	})
+}
+
+func TestUpdateOrderAccrualRepeatedFinalState(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		userID := newTestUser(t, store)
+		order := newTestOrder(t, store, userID)
+		for i := 0; i < 3; i++ {
+			before := IllegalTransitions()
+			err := store.UpdateOrderAccrual(ctx, &UsingAccrualStruct{Order: order, Status: OrderStateProcessed, Accrual: 1000})
+			if err != nil {
+				t.Fatalf("delivery %d of PROCESSED: %v", i+1, err)
+			}
+			if IllegalTransitions() != before {
+				t.Fatalf("delivery %d of PROCESSED was counted as an illegal transition", i+1)
+			}
+		}
+		balance := testBalance(t, store, userID)
+		if balance.Current != 1000 {
+			t.Fatalf("balance after redelivered PROCESSED is %s, want 10", balance.Current)
+		}
+		history, err := store.ReturnOrderHistory(ctx, order)
+		if err != nil || len(history) != 1 {
+			t.Fatalf("history after redelivered PROCESSED: %v, %v, want one change", history, err)
+		}
+
+		before := IllegalTransitions()
+		err = store.UpdateOrderAccrual(ctx, &UsingAccrualStruct{Order: order, Status: OrderStateInvalid})
+		if !errors.Is(err, ErrIllegalTransition) {
+			t.Fatalf("PROCESSED -> INVALID: %v, want ErrIllegalTransition", err)
+		}
+		if IllegalTransitions() != before+1 {
+			t.Fatalf("PROCESSED -> INVALID wasn't counted")
+		}
+	})
+}
+
+func TestNewWithdrawConcurrent(t *testing.T) {
+	const (
+		attempts = 50
+		funds    = money.Amount(100 * money.Scale)
+		sum      = money.Amount(7 * money.Scale)
+	)
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		userID := newTestUser(t, store)
+		fundTestUser(t, store, userID, funds)
+
+		done := make(chan struct{})
+		lowest := make(chan money.Amount)
+		go func() {
+			// watch the balance while the withdrawals race, it must never be overdrawn
+			min := funds
+			for {
+				select {
+				case <-done:
+					lowest <- min
+					return
+				default:
+				}
+				if balance := testBalanceOrZero(store, userID); balance.Current < min {
+					min = balance.Current
+				}
+			}
+		}()
+
+		var succeeded, refused int64
+		var wg sync.WaitGroup
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				id := userID
+				isBalance, result, err := store.NewWithdraw(ctx, &OrderToWithdrawStruct{IDOrder: uniqueOrderNumber(), Sum: sum}, &id)
+				switch {
+				case err != nil || !result:
+					t.Errorf("NewWithdraw: result %v, %v", result, err)
+				case isBalance:
+					atomic.AddInt64(&succeeded, 1)
+				default:
+					atomic.AddInt64(&refused, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		close(done)
+		if min := <-lowest; min < 0 {
+			t.Fatalf("current went down to %s", min)
+		}
+
+		if want := int64(funds / sum); succeeded != want || refused != attempts-want {
+			t.Fatalf("%d withdrawals succeeded and %d were refused, want %d and %d", succeeded, refused, want, attempts-want)
+		}
+		balance := testBalance(t, store, userID)
+		if balance.Current != funds-money.Amount(succeeded)*sum || balance.Withdrawn != money.Amount(succeeded)*sum {
+			t.Fatalf("balance current %s withdrawn %s after %d withdrawals", balance.Current, balance.Withdrawn, succeeded)
+		}
+		mismatches, err := store.Reconcile(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mismatch := range mismatches {
+			if mismatch.IDUser == userID {
+				t.Fatalf("balance doesn't match the ledger: %+v", mismatch)
+			}
+		}
+	})
+}
+
+func testBalanceOrZero(store Store, userID int) UsingUserBalanceStruct {
+	balance, _ := store.ReturnBalanceByUserID(context.Background(), &userID)
+	return balance
+}
+
+// withLocalZone runs the rest of the test as if TZ named a zone nine hours east of UTC,
+// times from time.Now() carry that zone like they do on such a host
+func withLocalZone(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+9", 9*60*60)
+	t.Cleanup(func() { time.Local = local })
+}
+
+func TestReturnOrdersDateFilterOutsideUTC(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		withLocalZone(t)
+		ctx := context.Background()
+		userID := newTestUser(t, store)
+		base := time.Now().Truncate(time.Second)
+		var numbers []string
+		for _, shift := range []time.Duration{-2 * time.Hour, -30 * time.Minute, 30 * time.Minute, 2 * time.Hour} {
+			number := uniqueOrderNumber()
+			err := store.InsertOrder(ctx, &UsingOrderStruct{
+				Number:     number,
+				IDUser:     userID,
+				State:      OrderStateNew,
+				UploadedAt: base.Add(shift),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			numbers = append(numbers, number)
+		}
+
+		// the bounds arrive in UTC like parsed RFC 3339 query values
+		filter := &ListFilter{From: base.Add(-time.Hour).UTC(), To: base.Add(time.Hour).UTC(), Limit: 1}
+		var got []string
+		for {
+			_, arrOrders, page, err := store.ReturnOrdersInfoByUserID(ctx, userID, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != 2 {
+				t.Fatalf("total %d, want 2", page.Total)
+			}
+			for _, order := range arrOrders {
+				got = append(got, order.Number)
+			}
+			if page.Next == nil {
+				break
+			}
+			filter.Cursor = page.Next
+		}
+		if len(got) != 2 || got[0] != numbers[1] || got[1] != numbers[2] {
+			t.Fatalf("orders in the last hour around now: %v, want %v", got, numbers[1:3])
+		}
+
+		orderInfo, err := store.ReturnOrderInfoByID(ctx, numbers[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := base.Add(-30 * time.Minute); !orderInfo.UploadedAt.Equal(want) {
+			t.Fatalf("uploaded_at read back as %s, want %s", orderInfo.UploadedAt, want)
+		}
+	})
+}
+
+func TestRotateSessionExpiryOutsideUTC(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		withLocalZone(t)
+		ctx := context.Background()
+		userID := newTestUser(t, store)
+		now := time.Now()
+		tests := []struct {
+			name        string
+			expiresAt   time.Time
+			wantRotated bool
+		}{
+			{name: "expired an hour ago", expiresAt: now.Add(-time.Hour), wantRotated: false},
+			{name: "expires in an hour", expiresAt: now.Add(time.Hour), wantRotated: true},
+		}
+		for _, tt := range tests {
+			oldSession := &SessionStruct{IDSession: uniqueName("session"), IDUser: userID, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: tt.expiresAt}
+			if err := store.InsertSession(ctx, oldSession); err != nil {
+				t.Fatal(err)
+			}
+			newSession := &SessionStruct{IDSession: uniqueName("session"), CreatedAt: now, ExpiresAt: now.Add(24 * time.Hour)}
+			_, rotated, err := store.RotateSession(ctx, oldSession.IDSession, newSession)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated != tt.wantRotated {
+				t.Fatalf("%s: rotated %v, want %v", tt.name, rotated, tt.wantRotated)
+			}
+		}
+	})
+}
+
+func TestNewWithdrawRepeatedAfterBalanceDrop(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		userID := newTestUser(t, store)
+		fundTestUser(t, store, userID, 1000)
+		order := uniqueOrderNumber()
+		isBalance, result, err := store.NewWithdraw(ctx, &OrderToWithdrawStruct{IDOrder: order, Sum: 600}, &userID)
+		if err != nil || !result || !isBalance {
+			t.Fatalf("first withdrawal: balance %v, result %v, %v", isBalance, result, err)
+		}
+		// the retry finds 4 points left, less than the 6 it asks for
+		_, _, err = store.NewWithdraw(ctx, &OrderToWithdrawStruct{IDOrder: order, Sum: 600}, &userID)
+		if !errors.Is(err, ErrWithdrawalExists) {
+			t.Fatalf("repeated withdrawal above the balance: %v, want ErrWithdrawalExists", err)
+		}
+		if balance := testBalance(t, store, userID); balance.Current != 400 || balance.Withdrawn != 600 {
+			t.Fatalf("balance current %s withdrawn %s, want 4 and 6", balance.Current, balance.Withdrawn)
+		}
+	})
+}
+
+func TestOrderHistoryTimesOutsideUTC(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		withLocalZone(t)
+		ctx := context.Background()
+		userID := newTestUser(t, store)
+		order := newTestOrder(t, store, userID)
+		err := store.UpdateOrderAccrual(ctx, &UsingAccrualStruct{Order: order, Status: OrderStateProcessed, Accrual: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		orderInfo, err := store.ReturnOrderInfoByID(ctx, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		history, err := store.ReturnOrderHistory(ctx, order)
+		if err != nil || len(history) != 1 {
+			t.Fatalf("history: %v, %v, want one change", history, err)
+		}
+		changedAt := history[0].ChangedAt
+		if changedAt.Before(orderInfo.UploadedAt) || changedAt.After(time.Now()) {
+			t.Fatalf("changed at %s, want between the upload at %s and now", changedAt, orderInfo.UploadedAt)
+		}
+	})
+}